@@ -1,7 +1,12 @@
 package main
 
 import (
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/mailer"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/oidc"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/passhash"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/passpolicy"
 	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/service"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/token"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 
@@ -16,6 +21,11 @@ func main() {
 		db.Module,
 		config.Module,
 		service.Module,
+		token.Module,
+		mailer.Module,
+		oidc.Module,
+		passhash.Module,
+		passpolicy.Module,
 		fx.Provide(
 			func() (*zap.SugaredLogger, error) {
 				l, err := zap.NewProduction()
@@ -0,0 +1,161 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountDelete(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	accountURL := AppBaseURL
+	accountURL.Path = "/auth/account"
+	cancelURL := AppBaseURL
+	cancelURL.Path = "/auth/account/cancel-deletion"
+	tagURL := AppBaseURL
+	tagURL.Path = "/tag"
+	bookmarkURL := AppBaseURL
+	bookmarkURL.Path = "/bookmark"
+
+	email := "delete@gmail.com"
+	nextEmail := "delete-next@gmail.com"
+	// audited with the email, there being no account yet
+	loginURL := AppBaseURL
+	loginURL.Path = "/auth/login"
+	var resp *resty.Response
+	var err error
+	for _, address := range []string{email, "Delete@Gmail.com", nextEmail} {
+		resp, err = resty.New().R().
+			SetContext(ctx).
+			SetBody(map[string]string{"email": address, "password": "plum-Tractor-Velvet-42"}).
+			Post(loginURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+	}
+
+	token := Register(ctx, t, email, "plum-Tractor-Velvet-42")
+	// the address the user asked to change to is theirs too, even unconfirmed
+	emailURL := AppBaseURL
+	emailURL.Path = "/auth/email"
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"email": nextEmail, "password": "plum-Tractor-Velvet-42"}).
+		Post(emailURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode())
+	var userID uint64
+	err = DBConn.QueryRow(ctx, "SELECT id FROM users WHERE email=$1", email).Scan(&userID)
+	assert.Nil(t, err)
+	other := Register(ctx, t, "keep@gmail.com", "plum-Tractor-Velvet-42")
+
+	for _, accessToken := range []string{token, other} {
+		tag := struct {
+			ID uint64 `json:"id"`
+		}{}
+		resp, err = resty.New().R().
+			SetHeader("x-token", accessToken).
+			SetContext(ctx).
+			SetBody(map[string]string{"name": "tag"}).
+			SetResult(&tag).
+			Post(tagURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+		resp, err = resty.New().R().
+			SetHeader("x-token", accessToken).
+			SetContext(ctx).
+			SetBody(map[string]interface{}{"name": "bookmark", "tags": []uint64{tag.ID}}).
+			Post(bookmarkURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"password": "wrong wrong wrong"}).
+		Delete(accountURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		Post(cancelURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"password": "plum-Tractor-Velvet-42"}).
+		Delete(accountURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		Post(cancelURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"password": "plum-Tractor-Velvet-42"}).
+		Delete(accountURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode())
+
+	// the functional setup has a grace period of a few seconds
+	purged := false
+	for !purged && ctx.Err() == nil {
+		var users int
+		err = DBConn.QueryRow(ctx, "SELECT count(*) FROM users WHERE email=$1", email).Scan(&users)
+		assert.Nil(t, err)
+		purged = users == 0
+		time.Sleep(time.Millisecond * 500)
+	}
+	assert.True(t, purged)
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		Get(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	var rows int
+	err = DBConn.QueryRow(ctx, "SELECT (SELECT count(*) FROM bookmarks) + (SELECT count(*) FROM tags) + "+
+		"(SELECT count(*) FROM tag_bookmarks) + (SELECT count(*) FROM sessions)").Scan(&rows)
+	assert.Nil(t, err)
+	// only the other user's bookmark, tag, link between them and session are left
+	assert.Equal(t, 4, rows)
+
+	var throttles int
+	err = DBConn.QueryRow(ctx, "SELECT count(*) FROM login_throttles WHERE key LIKE $1", "%:"+email).Scan(&throttles)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, throttles)
+
+	// audit events stay, but nothing tells they were the user's
+	var identifying, anonymous int
+	err = DBConn.QueryRow(ctx, "SELECT count(*) FROM audit_events "+
+		"WHERE user_id=$1 OR actor_id=$1 OR details ILIKE $2 OR details ILIKE $3",
+		userID, "%"+email+"%", "%"+nextEmail+"%").Scan(&identifying)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, identifying)
+	err = DBConn.QueryRow(ctx, "SELECT count(*) FROM audit_events WHERE event='register' AND user_id IS NULL AND ip=''").
+		Scan(&anonymous)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, anonymous)
+}
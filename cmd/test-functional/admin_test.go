@@ -0,0 +1,172 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type AdminUserResp struct {
+	ID            uint64 `json:"id"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	BookmarkCount int64  `json:"bookmark_count"`
+	TagCount      int64  `json:"tag_count"`
+}
+
+func TestAdmin(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	usersURL := AppBaseURL
+	usersURL.Path = "/admin/users"
+	verifyURL := AppBaseURL
+	verifyURL.Path = "/auth/verify"
+	tagURL := AppBaseURL
+	tagURL.Path = "/tag"
+
+	// admin@gmail.com is listed in ADMIN_EMAILS and promoted once verified
+	adminEmail := "admin@gmail.com"
+	seen := len(MailsTo(t, adminEmail))
+	admin := Register(ctx, t, adminEmail, "plum-Tractor-Velvet-42")
+	resp, err := resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": LastMailToken(ctx, t, adminEmail, seen)}).
+		Post(verifyURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	userEmail := "user@gmail.com"
+	user := Register(ctx, t, userEmail, "plum-Tractor-Velvet-42")
+	resp, err = resty.New().R().
+		SetHeader("x-token", user).
+		SetContext(ctx).
+		SetBody(map[string]string{"name": "tag"}).
+		Post(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", user).
+		SetContext(ctx).
+		Get(usersURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	list := struct {
+		Items []AdminUserResp `json:"items"`
+		Total int64           `json:"total"`
+	}{}
+	for {
+		resp, err = resty.New().R().
+			SetHeader("x-token", admin).
+			SetContext(ctx).
+			SetQueryParam("q", "USER@").
+			SetResult(&list).
+			Get(usersURL.String())
+		assert.Nil(t, err)
+		if resp.StatusCode() != http.StatusForbidden || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, int64(1), list.Total)
+	if assert.Len(t, list.Items, 1) {
+		assert.Equal(t, userEmail, list.Items[0].Email)
+		assert.Equal(t, "user", list.Items[0].Role)
+		assert.Equal(t, int64(1), list.Items[0].TagCount)
+		assert.Equal(t, int64(0), list.Items[0].BookmarkCount)
+	}
+	userURL := usersURL
+	userURL.Path += "/" + strconv.FormatUint(list.Items[0].ID, 10)
+
+	adminUser := AdminUserResp{}
+	resp, err = resty.New().R().
+		SetHeader("x-token", admin).
+		SetContext(ctx).
+		SetQueryParam("q", adminEmail).
+		SetResult(&list).
+		Get(usersURL.String())
+	assert.Nil(t, err)
+	if assert.Len(t, list.Items, 1) {
+		adminUser = list.Items[0]
+		assert.Equal(t, "admin", adminUser.Role)
+	}
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", admin).
+		SetContext(ctx).
+		Post(usersURL.String() + "/" + strconv.FormatUint(adminUser.ID, 10) + "/disable")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", admin).
+		SetContext(ctx).
+		Post(userURL.String() + "/disable")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", user).
+		SetContext(ctx).
+		Get(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	loginURL := AppBaseURL
+	loginURL.Path = "/auth/login"
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": userEmail, "password": "plum-Tractor-Velvet-42"}).
+		Post(loginURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", admin).
+		SetContext(ctx).
+		Post(userURL.String() + "/enable")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	user = Login(ctx, t, userEmail, "plum-Tractor-Velvet-42")
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", admin).
+		SetContext(ctx).
+		Post(userURL.String() + "/logout")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", user).
+		SetContext(ctx).
+		Get(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	seen = len(MailsTo(t, userEmail))
+	resp, err = resty.New().R().
+		SetHeader("x-token", admin).
+		SetContext(ctx).
+		Post(userURL.String() + "/password-reset")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	assert.NotEmpty(t, LastMailToken(ctx, t, userEmail, seen))
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", admin).
+		SetContext(ctx).
+		Post(usersURL.String() + "/0/logout")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+}
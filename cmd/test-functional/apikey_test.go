@@ -0,0 +1,92 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	keysURL := AppBaseURL
+	keysURL.Path = "/auth/api-keys"
+	tagURL := AppBaseURL
+	tagURL.Path = "/tag"
+	sessionsURL := AppBaseURL
+	sessionsURL.Path = "/auth/sessions"
+
+	accessToken := Register(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+
+	type Key struct {
+		ID     uint64   `json:"id"`
+		Scopes []string `json:"scopes"`
+		Key    string   `json:"key"`
+	}
+	resp, err := resty.New().R().
+		SetHeader("x-token", accessToken).
+		SetContext(ctx).
+		SetResult(&Key{}).
+		SetBody(map[string]interface{}{"name": "script", "scopes": []string{"tags:read"}}).
+		Post(keysURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	key := resp.Result().(*Key)
+	assert.NotEmpty(t, key.Key)
+	assert.Equal(t, []string{"tags:read"}, key.Scopes)
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", key.Key).
+		SetContext(ctx).
+		Get(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", key.Key).
+		SetContext(ctx).
+		SetBody(map[string]string{"name": "tag"}).
+		Post(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", key.Key).
+		SetContext(ctx).
+		Get(sessionsURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", accessToken).
+		SetContext(ctx).
+		SetResult(&[]Key{}).
+		Get(keysURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	keys := *resp.Result().(*[]Key)
+	assert.Len(t, keys, 1)
+	assert.Empty(t, keys[0].Key)
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", accessToken).
+		SetContext(ctx).
+		Delete(keysURL.String() + "/" + strconv.FormatUint(key.ID, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", key.Key).
+		SetContext(ctx).
+		Get(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+}
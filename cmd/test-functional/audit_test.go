@@ -0,0 +1,128 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type AuditListResp struct {
+	Items []struct {
+		ID      uint64  `json:"id"`
+		Event   string  `json:"event"`
+		Outcome string  `json:"outcome"`
+		UserID  *uint64 `json:"user_id"`
+		Details string  `json:"details"`
+	} `json:"items"`
+	NextBefore *uint64 `json:"next_before"`
+}
+
+func TestAuditLog(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	auditURL := AppBaseURL
+	auditURL.Path = "/auth/audit"
+	adminAuditURL := AppBaseURL
+	adminAuditURL.Path = "/admin/audit"
+	loginURL := AppBaseURL
+	loginURL.Path = "/auth/login"
+
+	email := "audit@gmail.com"
+	password := "plum-Tractor-Velvet-42"
+	token := Register(ctx, t, email, password)
+
+	resp, err := resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": email, "password": "wrong-Password-Entirely-1"}).
+		Post(loginURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+	Login(ctx, t, email, password)
+
+	// someone else's events are not shown
+	Register(ctx, t, "audit-other@gmail.com", password)
+
+	// a failed registration doesn't keep the address it was tried with
+	registerURL := AppBaseURL
+	registerURL.Path = "/auth/register"
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": email, "password": password}).
+		Post(registerURL.String())
+	assert.Nil(t, err)
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode())
+	var withEmail int
+	err = DBConn.QueryRow(ctx, "SELECT count(*) FROM audit_events WHERE details LIKE $1", "%"+email+"%").Scan(&withEmail)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, withEmail)
+
+	list := AuditListResp{}
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetResult(&list).
+		Get(auditURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	if assert.Len(t, list.Items, 3) {
+		assert.Equal(t, "login", list.Items[0].Event)
+		assert.Equal(t, "success", list.Items[0].Outcome)
+		assert.Equal(t, "login", list.Items[1].Event)
+		assert.Equal(t, "failure", list.Items[1].Outcome)
+		assert.Equal(t, "register", list.Items[2].Event)
+	}
+	assert.Nil(t, list.NextBefore)
+
+	list = AuditListResp{}
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetQueryParams(map[string]string{"event": "login", "limit": "1"}).
+		SetResult(&list).
+		Get(auditURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	if assert.Len(t, list.Items, 1) && assert.NotNil(t, list.NextBefore) {
+		assert.Equal(t, "success", list.Items[0].Outcome)
+
+		next := AuditListResp{}
+		resp, err = resty.New().R().
+			SetHeader("x-token", token).
+			SetContext(ctx).
+			SetQueryParams(map[string]string{
+				"event":  "login",
+				"limit":  "1",
+				"before": strconv.FormatUint(*list.NextBefore, 10),
+			}).
+			SetResult(&next).
+			Get(auditURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		if assert.Len(t, next.Items, 1) {
+			assert.Equal(t, "failure", next.Items[0].Outcome)
+		}
+	}
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetQueryParam("from", "yesterday").
+		Get(auditURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		Get(adminAuditURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+}
@@ -0,0 +1,423 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	TagResp struct {
+		ID   uint64 `json:"id"`
+		Name string `json:"name"`
+	}
+
+	BookmarkResp struct {
+		ID          uint64    `json:"id"`
+		Name        *string   `json:"name"`
+		Link        *string   `json:"link"`
+		Description *string   `json:"description"`
+		Tags        []TagResp `json:"tags"`
+		CreatedAt   time.Time `json:"created_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
+		Match       *struct {
+			Rank                 float32 `json:"rank"`
+			NameHighlight        string  `json:"name_highlight"`
+			DescriptionHighlight string  `json:"description_highlight"`
+		} `json:"match"`
+	}
+
+	BookmarkListResp struct {
+		Items      []BookmarkResp `json:"items"`
+		NextCursor string         `json:"next_cursor"`
+	}
+)
+
+func TestBookmarkGetOne(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	bookmarkURL := AppBaseURL
+	bookmarkURL.Path = "/bookmark"
+
+	token := Register(ctx, t, "bookmarks@gmail.com", "plum-Tractor-Velvet-42")
+	other := Register(ctx, t, "bookmarks-other@gmail.com", "plum-Tractor-Velvet-42")
+
+	tag := CreateTag(ctx, t, token, "golang")
+	created := CreateBookmark(ctx, t, token, map[string]interface{}{
+		"name": "Go",
+		"link": "https://go.dev",
+		"tags": []uint64{tag.ID},
+	})
+
+	got := BookmarkResp{}
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetResult(&got).
+		Get(bookmarkURL.String() + "/" + strconv.FormatUint(created.ID, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, created.ID, got.ID)
+	assert.Equal(t, "https://go.dev", *got.Link)
+	assert.Equal(t, []TagResp{tag}, got.Tags)
+	assert.False(t, got.CreatedAt.IsZero())
+	assert.False(t, got.UpdatedAt.IsZero())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", other).
+		SetContext(ctx).
+		Get(bookmarkURL.String() + "/" + strconv.FormatUint(created.ID, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		Get(bookmarkURL.String() + "/" + strconv.FormatUint(created.ID+1000, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+}
+
+func TestBookmarkPagination(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	bookmarkURL := AppBaseURL
+	bookmarkURL.Path = "/bookmark"
+
+	token := Register(ctx, t, "pages@gmail.com", "plum-Tractor-Velvet-42")
+	ids := make([]uint64, 5)
+	for i := range ids {
+		ids[i] = CreateBookmark(ctx, t, token, map[string]interface{}{"name": "bookmark " + strconv.Itoa(i)}).ID
+	}
+
+	first := ListBookmarks(ctx, t, token, map[string]interface{}{"limit": 2})
+	assert.Equal(t, ids[:2], BookmarkIDs(first.Items))
+	assert.NotEmpty(t, first.NextCursor)
+
+	// changes behind and ahead of the cursor don't disturb the following pages
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		Delete(bookmarkURL.String() + "/" + strconv.FormatUint(ids[0], 10))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	added := CreateBookmark(ctx, t, token, map[string]interface{}{"name": "added"}).ID
+
+	second := ListBookmarks(ctx, t, token, map[string]interface{}{"limit": 2, "cursor": first.NextCursor})
+	assert.Equal(t, ids[2:4], BookmarkIDs(second.Items))
+
+	last := ListBookmarks(ctx, t, token, map[string]interface{}{"limit": 2, "cursor": second.NextCursor})
+	assert.Equal(t, []uint64{ids[4], added}, BookmarkIDs(last.Items))
+	assert.Empty(t, last.NextCursor)
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]interface{}{"cursor": "not a cursor"}).
+		Post(bookmarkURL.String() + "/list")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+}
+
+func TestBookmarkResponses(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	bookmarkURL := AppBaseURL
+	bookmarkURL.Path = "/bookmark"
+
+	token := Register(ctx, t, "responses@gmail.com", "plum-Tractor-Velvet-42")
+	db := CreateTag(ctx, t, token, "db")
+	golang := CreateTag(ctx, t, token, "golang")
+
+	created := CreateBookmark(ctx, t, token, map[string]interface{}{
+		"name": "pgx",
+		"tags": []uint64{golang.ID, db.ID},
+	})
+	assert.Equal(t, []TagResp{db, golang}, created.Tags)
+	assert.False(t, created.CreatedAt.IsZero())
+
+	updated := BookmarkResp{}
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]interface{}{"description": "PostgreSQL driver"}).
+		SetResult(&updated).
+		Patch(bookmarkURL.String() + "/" + strconv.FormatUint(created.ID, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, []TagResp{db, golang}, updated.Tags)
+	assert.Equal(t, created.CreatedAt.Unix(), updated.CreatedAt.Unix())
+	assert.False(t, updated.UpdatedAt.Before(created.UpdatedAt))
+
+	untagged := CreateBookmark(ctx, t, token, map[string]interface{}{"name": "untagged"})
+	assert.NotNil(t, untagged.Tags)
+	assert.Empty(t, untagged.Tags)
+
+	list := ListBookmarks(ctx, t, token, map[string]interface{}{})
+	assert.Len(t, list.Items, 2)
+	for _, item := range list.Items {
+		assert.False(t, item.UpdatedAt.IsZero())
+		switch item.ID {
+		case created.ID:
+			assert.Equal(t, []TagResp{db, golang}, item.Tags)
+			assert.Equal(t, "PostgreSQL driver", *item.Description)
+		case untagged.ID:
+			assert.Empty(t, item.Tags)
+		default:
+			t.Errorf("unexpected bookmark %d", item.ID)
+		}
+	}
+}
+
+func TestBookmarkTagFilters(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	token := Register(ctx, t, "filters@gmail.com", "plum-Tractor-Velvet-42")
+	a := CreateTag(ctx, t, token, "a").ID
+	b := CreateTag(ctx, t, token, "b").ID
+	c := CreateTag(ctx, t, token, "c").ID
+
+	onlyA := CreateBookmark(ctx, t, token, map[string]interface{}{"name": "a", "tags": []uint64{a}}).ID
+	ab := CreateBookmark(ctx, t, token, map[string]interface{}{"name": "ab", "tags": []uint64{a, b}}).ID
+	bc := CreateBookmark(ctx, t, token, map[string]interface{}{"name": "bc", "tags": []uint64{b, c}}).ID
+	untagged := CreateBookmark(ctx, t, token, map[string]interface{}{"name": "untagged"}).ID
+
+	cases := []struct {
+		name   string
+		filter map[string]interface{}
+		want   []uint64
+	}{
+		{"everything once", map[string]interface{}{}, []uint64{onlyA, ab, bc, untagged}},
+		{"all", map[string]interface{}{"tags_all": []uint64{a, b}}, []uint64{ab}},
+		{"any", map[string]interface{}{"tags_any": []uint64{a, b}}, []uint64{onlyA, ab, bc}},
+		{"legacy any", map[string]interface{}{"tags": []uint64{a, c}}, []uint64{onlyA, ab, bc}},
+		{"none", map[string]interface{}{"tags_none": []uint64{c}}, []uint64{onlyA, ab, untagged}},
+		{"untagged", map[string]interface{}{"untagged": true}, []uint64{untagged}},
+		{"combined", map[string]interface{}{"tags_any": []uint64{a, b}, "tags_none": []uint64{a}}, []uint64{bc}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			list := ListBookmarks(ctx, t, token, tc.filter)
+			assert.Equal(t, tc.want, BookmarkIDs(list.Items))
+		})
+	}
+}
+
+func TestBookmarkSearch(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	token := Register(ctx, t, "search@gmail.com", "plum-Tractor-Velvet-42")
+	archived := CreateTag(ctx, t, token, "archived").ID
+
+	inLink := CreateBookmark(ctx, t, token, map[string]interface{}{
+		"name": "Driver",
+		"link": "https://github.com/jackc/pgx",
+	}).ID
+	inDescription := CreateBookmark(ctx, t, token, map[string]interface{}{
+		"name":        "Notes",
+		"description": "Tuning postgres indexes & vacuum",
+	}).ID
+	inName := CreateBookmark(ctx, t, token, map[string]interface{}{"name": "Postgres indexing"}).ID
+	inArchived := CreateBookmark(ctx, t, token, map[string]interface{}{
+		"name": "Old postgres notes",
+		"tags": []uint64{archived},
+	}).ID
+	CreateBookmark(ctx, t, token, map[string]interface{}{"name": "Unrelated"})
+
+	list := ListBookmarks(ctx, t, token, map[string]interface{}{"q": "postgres index"})
+	assert.Equal(t, []uint64{inName, inDescription}, BookmarkIDs(list.Items))
+	if assert.Len(t, list.Items, 2) && assert.NotNil(t, list.Items[0].Match) {
+		assert.Equal(t, "<mark>Postgres</mark> <mark>indexing</mark>", list.Items[0].Match.NameHighlight)
+		assert.True(t, list.Items[0].Match.Rank > list.Items[1].Match.Rank)
+		assert.Contains(t, list.Items[1].Match.DescriptionHighlight, "<mark>postgres</mark> <mark>indexes</mark> &amp;")
+	}
+
+	list = ListBookmarks(ctx, t, token, map[string]interface{}{"q": "github"})
+	assert.Equal(t, []uint64{inLink}, BookmarkIDs(list.Items))
+
+	list = ListBookmarks(ctx, t, token, map[string]interface{}{"q": "postgres", "tags_none": []uint64{archived}})
+	assert.ElementsMatch(t, []uint64{inName, inDescription}, BookmarkIDs(list.Items))
+
+	// pages of a search follow the ranking
+	all := ListBookmarks(ctx, t, token, map[string]interface{}{"q": "postgres"})
+	assert.ElementsMatch(t, []uint64{inName, inDescription, inArchived}, BookmarkIDs(all.Items))
+	first := ListBookmarks(ctx, t, token, map[string]interface{}{"q": "postgres", "limit": 2})
+	assert.NotEmpty(t, first.NextCursor)
+	last := ListBookmarks(ctx, t, token, map[string]interface{}{"q": "postgres", "limit": 2, "cursor": first.NextCursor})
+	assert.Empty(t, last.NextCursor)
+	assert.Equal(t, BookmarkIDs(all.Items), append(BookmarkIDs(first.Items), BookmarkIDs(last.Items)...))
+
+	// a cursor of a search is refused for the plain list
+	u := AppBaseURL
+	u.Path = "/bookmark/list"
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]interface{}{"cursor": first.NextCursor}).
+		Post(u.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	list = ListBookmarks(ctx, t, token, map[string]interface{}{})
+	assert.Nil(t, list.Items[0].Match)
+}
+
+func TestBookmarkSearchQuery(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	token := Register(ctx, t, "query@gmail.com", "plum-Tractor-Velvet-42")
+	db := CreateTag(ctx, t, token, "db").ID
+	archived := CreateTag(ctx, t, token, "archived").ID
+
+	pgx := CreateBookmark(ctx, t, token, map[string]interface{}{
+		"name": "golang postgres driver",
+		"link": "https://github.com/jackc/pgx",
+		"tags": []uint64{db},
+	}).ID
+	oldPgx := CreateBookmark(ctx, t, token, map[string]interface{}{
+		"name": "golang postgres driver, old",
+		"link": "https://gist.github.com/pq",
+		"tags": []uint64{db, archived},
+	}).ID
+	goDev := CreateBookmark(ctx, t, token, map[string]interface{}{
+		"name": "golang home",
+		"link": "https://go.dev",
+	}).ID
+	notes := CreateBookmark(ctx, t, token, map[string]interface{}{"description": "golang exact phrase here"}).ID
+
+	cases := []struct {
+		query string
+		want  []uint64
+	}{
+		{"tag:DB", []uint64{pgx, oldPgx}},
+		{"tag:db -tag:archived", []uint64{pgx}},
+		{"site:github.com", []uint64{pgx, oldPgx}},
+		{"-site:github.com", []uint64{goDev, notes}},
+		{"is:untagged", []uint64{goDev, notes}},
+		{"before:2000-01-01", []uint64{}},
+		{"after:2000-01-01 -is:untagged", []uint64{pgx, oldPgx}},
+		{`golang tag:db -tag:archived site:github.com after:2000-01-01`, []uint64{pgx}},
+		{`"exact phrase" is:untagged`, []uint64{notes}},
+		{`golang -"exact phrase" -postgres`, []uint64{goDev}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			list := ListBookmarks(ctx, t, token, map[string]interface{}{"q": tc.query})
+			assert.ElementsMatch(t, tc.want, BookmarkIDs(list.Items))
+		})
+	}
+
+	// only text makes a search with matches
+	list := ListBookmarks(ctx, t, token, map[string]interface{}{"q": "tag:db"})
+	assert.Nil(t, list.Items[0].Match)
+	list = ListBookmarks(ctx, t, token, map[string]interface{}{"q": "golang tag:db"})
+	assert.NotNil(t, list.Items[0].Match)
+
+	u := AppBaseURL
+	u.Path = "/bookmark/list"
+	syntaxErr := struct {
+		Message  string `json:"message"`
+		Position int    `json:"position"`
+	}{}
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]interface{}{"q": "golang before:tomorrow"}).
+		SetError(&syntaxErr).
+		Post(u.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Equal(t, 14, syntaxErr.Position)
+	assert.NotEmpty(t, syntaxErr.Message)
+}
+
+// ListBookmarks lists bookmarks through the API.
+func ListBookmarks(ctx context.Context, t *testing.T, token string, body map[string]interface{}) BookmarkListResp {
+	u := AppBaseURL
+	u.Path = "/bookmark/list"
+
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(body).
+		SetResult(&BookmarkListResp{}).
+		Post(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		t.Fatalf("bookmark list failed with status %d: %s", resp.StatusCode(), resp.String())
+	}
+	return *resp.Result().(*BookmarkListResp)
+}
+
+func BookmarkIDs(bookmarks []BookmarkResp) []uint64 {
+	ids := make([]uint64, len(bookmarks))
+	for i := range bookmarks {
+		ids[i] = bookmarks[i].ID
+	}
+	return ids
+}
+
+// CreateTag creates a tag through the API.
+func CreateTag(ctx context.Context, t *testing.T, token, name string) TagResp {
+	u := AppBaseURL
+	u.Path = "/tag"
+
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"name": name}).
+		SetResult(&TagResp{}).
+		Post(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		t.Fatalf("tag creation failed with status %d: %s", resp.StatusCode(), resp.String())
+	}
+	return *resp.Result().(*TagResp)
+}
+
+// CreateBookmark creates a bookmark through the API.
+func CreateBookmark(ctx context.Context, t *testing.T, token string, body map[string]interface{}) BookmarkResp {
+	u := AppBaseURL
+	u.Path = "/bookmark"
+
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(body).
+		SetResult(&BookmarkResp{}).
+		Post(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		t.Fatalf("bookmark creation failed with status %d: %s", resp.StatusCode(), resp.String())
+	}
+	return *resp.Result().(*BookmarkResp)
+}
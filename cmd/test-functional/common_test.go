@@ -30,7 +30,7 @@ func TestRegister(t *testing.T) {
 			SetContext(ctx).
 			SetResult(&Resp{}).
 			SetBody(`
-			{"email": "test@gmail.com", "password": "111111111111"}
+			{"email": "test@gmail.com", "password": "plum-Tractor-Velvet-42"}
 		`).
 			Post(u.String())
 		assert.Nil(t, err)
@@ -41,14 +41,10 @@ func TestRegister(t *testing.T) {
 		assert.True(t, ok)
 		assert.NotEmpty(t, got.Token)
 
-		var (
-			id    uint64
-			token string
-		)
-		err = DBConn.QueryRow(ctx, "SELECT id, token FROM users WHERE token=$1", got.Token).Scan(&id, &token)
+		var sessions int
+		err = DBConn.QueryRow(ctx, "SELECT count(*) FROM sessions s JOIN users u ON u.id = s.user_id WHERE u.email=$1", "test@gmail.com").Scan(&sessions)
 		assert.Nil(t, err)
-
-		assert.Equal(t, token, got.Token)
+		assert.Equal(t, 1, sessions)
 	})
 
 	t.Run("bad body", func(t *testing.T) {
@@ -117,3 +113,161 @@ func TestRegister(t *testing.T) {
 //		Description: &l,
 //	}}, got)
 //}
+
+func TestLoginKeepsOtherSessions(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	tagURL := AppBaseURL
+	tagURL.Path = "/tag"
+
+	first := Register(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+	second := Login(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+	assert.NotEqual(t, first, second)
+
+	for _, token := range []string{first, second} {
+		resp, err := resty.New().R().
+			SetHeader("x-token", token).
+			SetContext(ctx).
+			Get(tagURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+}
+
+func TestSessions(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	sessionsURL := AppBaseURL
+	sessionsURL.Path = "/auth/sessions"
+	logoutURL := AppBaseURL
+	logoutURL.Path = "/auth/logout"
+
+	laptop := Register(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+	phone := Login(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+	extension := Login(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+
+	type Session struct {
+		ID      uint64 `json:"id"`
+		Current bool   `json:"current"`
+	}
+	resp, err := resty.New().R().
+		SetHeader("x-token", laptop).
+		SetContext(ctx).
+		SetResult(&[]Session{}).
+		Get(sessionsURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	sessions := *resp.Result().(*[]Session)
+	assert.Len(t, sessions, 3)
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", extension).
+		SetContext(ctx).
+		Post(logoutURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", extension).
+		SetContext(ctx).
+		Get(sessionsURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", laptop).
+		SetContext(ctx).
+		Delete(sessionsURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", phone).
+		SetContext(ctx).
+		Get(sessionsURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	// stored for the other instances until the access tokens expire
+	var revoked int
+	err = DBConn.QueryRow(ctx, "SELECT count(*) FROM revoked_sessions WHERE expires_at > now()").Scan(&revoked)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, revoked)
+}
+
+func TestRefresh(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	refreshURL := AppBaseURL
+	refreshURL.Path = "/auth/refresh"
+	tagURL := AppBaseURL
+	tagURL.Path = "/tag"
+
+	registerURL := AppBaseURL
+	registerURL.Path = "/auth/register"
+	resp, err := resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetContext(ctx).
+		SetResult(&TokenResp{}).
+		SetBody(`{"email": "test@gmail.com", "password": "plum-Tractor-Velvet-42"}`).
+		Post(registerURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	first := resp.Result().(*TokenResp)
+	assert.NotEmpty(t, first.RefreshToken)
+
+	// only a hash and a short prefix of the refresh token are stored
+	var (
+		hash   string
+		prefix string
+	)
+	err = DBConn.QueryRow(ctx, "SELECT token_hash, token_prefix FROM refresh_tokens").Scan(&hash, &prefix)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.RefreshToken, hash)
+	assert.Equal(t, first.RefreshToken[:len(prefix)], prefix)
+	assert.Less(t, len(prefix), len(first.RefreshToken))
+
+	resp, err = resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetContext(ctx).
+		SetResult(&TokenResp{}).
+		SetBody(map[string]string{"refresh_token": first.RefreshToken}).
+		Post(refreshURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	second := resp.Result().(*TokenResp)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", second.Token).
+		SetContext(ctx).
+		Get(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	// using the first refresh token again means it leaked, so the whole session goes away
+	resp, err = resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetContext(ctx).
+		SetBody(map[string]string{"refresh_token": first.RefreshToken}).
+		Post(refreshURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("Content-Type", "application/json").
+		SetContext(ctx).
+		SetBody(map[string]string{"refresh_token": second.RefreshToken}).
+		Post(refreshURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+}
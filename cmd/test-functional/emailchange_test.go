@@ -0,0 +1,104 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailChange(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	changeURL := AppBaseURL
+	changeURL.Path = "/auth/email"
+	confirmURL := AppBaseURL
+	confirmURL.Path = "/auth/email/confirm"
+	resetRequestURL := AppBaseURL
+	resetRequestURL.Path = "/auth/password/reset-request"
+	resetURL := AppBaseURL
+	resetURL.Path = "/auth/password/reset"
+
+	password := "plum-Tractor-Velvet-42"
+	oldEmail := "old-address@gmail.com"
+	newEmail := "new-address@gmail.com"
+	token := Register(ctx, t, oldEmail, password)
+	Register(ctx, t, "taken-address@gmail.com", password)
+
+	change := func(email, password string) *resty.Response {
+		resp, err := resty.New().R().
+			SetHeader("x-token", token).
+			SetContext(ctx).
+			SetBody(map[string]string{"email": email, "password": password}).
+			Post(changeURL.String())
+		assert.Nil(t, err)
+		return resp
+	}
+	confirm := func(token string) *resty.Response {
+		resp, err := resty.New().R().
+			SetContext(ctx).
+			SetBody(map[string]string{"token": token}).
+			Post(confirmURL.String())
+		assert.Nil(t, err)
+		return resp
+	}
+
+	assert.Equal(t, http.StatusForbidden, change(newEmail, "quiet-Harbor-Lantern-97").StatusCode())
+	assert.Equal(t, http.StatusBadRequest, change(oldEmail, password).StatusCode())
+	assert.Equal(t, http.StatusConflict, change("taken-address@gmail.com", password).StatusCode())
+
+	assert.Equal(t, http.StatusAccepted, change(newEmail, password).StatusCode())
+	confirmToken := LastMailToken(ctx, t, newEmail, 0)
+
+	// the current address is told about the change, without a link
+	for {
+		mails := MailsTo(t, oldEmail)
+		if len(mails) != 0 && mails[len(mails)-1].Subject == "Your Bookmarker email is about to change" {
+			assert.Contains(t, mails[len(mails)-1].Body, newEmail)
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("no notice sent to the old address")
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	// a reset link sent to the old address before the change
+	seen := len(MailsTo(t, oldEmail))
+	resp, err := resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": oldEmail}).
+		Post(resetRequestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	resetToken := LastMailToken(ctx, t, oldEmail, seen)
+
+	assert.Equal(t, http.StatusNoContent, confirm(confirmToken).StatusCode())
+	assert.Equal(t, http.StatusBadRequest, confirm(confirmToken).StatusCode())
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": resetToken, "password": "amber-Meadow-Whistle-18"}).
+		Post(resetURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	Login(ctx, t, newEmail, password)
+
+	// the address is taken by someone else before the link is opened
+	contested := "contested-address@gmail.com"
+	assert.Equal(t, http.StatusAccepted, change(contested, password).StatusCode())
+	confirmToken = LastMailToken(ctx, t, contested, 0)
+	Register(ctx, t, contested, password)
+	assert.Equal(t, http.StatusConflict, confirm(confirmToken).StatusCode())
+
+	var email string
+	err = DBConn.QueryRow(ctx, "SELECT email FROM users WHERE email=$1", newEmail).Scan(&email)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,159 @@
+package test_functional
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type DataExportResp struct {
+	ID          uint64 `json:"id"`
+	Status      string `json:"status"`
+	DownloadURL string `json:"download_url"`
+}
+
+func TestDataExport(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	exportURL := AppBaseURL
+	exportURL.Path = "/auth/export"
+	tagURL := AppBaseURL
+	tagURL.Path = "/tag"
+	bookmarkURL := AppBaseURL
+	bookmarkURL.Path = "/bookmark"
+
+	token := Register(ctx, t, "export@gmail.com", "plum-Tractor-Velvet-42")
+	other := Register(ctx, t, "other@gmail.com", "plum-Tractor-Velvet-42")
+
+	tag := struct {
+		ID uint64 `json:"id"`
+	}{}
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"name": "reading"}).
+		SetResult(&tag).
+		Post(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]interface{}{"name": "Go", "link": "https://golang.org", "tags": []uint64{tag.ID}}).
+		Post(bookmarkURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	created := DataExportResp{}
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetResult(&created).
+		Post(exportURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode())
+
+	statusURL := AppBaseURL
+	statusURL.Path = "/auth/export/" + strconv.FormatUint(created.ID, 10)
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", other).
+		SetContext(ctx).
+		Get(statusURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+
+	export := DataExportResp{}
+	for export.Status != "done" && ctx.Err() == nil {
+		resp, err = resty.New().R().
+			SetHeader("x-token", token).
+			SetContext(ctx).
+			SetResult(&export).
+			Get(statusURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.NotEqual(t, "failed", export.Status)
+		time.Sleep(time.Millisecond * 200)
+	}
+	assert.NotEmpty(t, export.DownloadURL)
+
+	// the finished export is handed out again until it expires
+	again := DataExportResp{}
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetResult(&again).
+		Post(exportURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, created.ID, again.ID)
+	assert.Equal(t, "done", again.Status)
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		Get(export.DownloadURL + "0")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		Get(export.DownloadURL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	archive, err := zip.NewReader(bytes.NewReader(resp.Body()), int64(len(resp.Body())))
+	assert.Nil(t, err)
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		assert.Nil(t, err)
+		files[f.Name], err = ioutil.ReadAll(r)
+		assert.Nil(t, err)
+	}
+
+	profile := struct {
+		Email string `json:"email"`
+	}{}
+	assert.Nil(t, json.Unmarshal(files["profile.json"], &profile))
+	assert.Equal(t, "export@gmail.com", profile.Email)
+
+	bookmarks := make([]struct {
+		Link      string    `json:"link"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+		Tags      []struct {
+			Name string `json:"name"`
+		} `json:"tags"`
+	}, 0)
+	assert.Nil(t, json.Unmarshal(files["bookmarks.json"], &bookmarks))
+	if assert.Len(t, bookmarks, 1) {
+		assert.Equal(t, "https://golang.org", bookmarks[0].Link)
+		assert.False(t, bookmarks[0].CreatedAt.IsZero())
+		assert.False(t, bookmarks[0].UpdatedAt.IsZero())
+		if assert.Len(t, bookmarks[0].Tags, 1) {
+			assert.Equal(t, "reading", bookmarks[0].Tags[0].Name)
+		}
+	}
+
+	tags := make([]struct {
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"created_at"`
+	}, 0)
+	assert.Nil(t, json.Unmarshal(files["tags.json"], &tags))
+	if assert.Len(t, tags, 1) {
+		assert.False(t, tags[0].CreatedAt.IsZero())
+	}
+}
@@ -0,0 +1,100 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type InviteResp struct {
+	ID      uint64 `json:"id"`
+	Prefix  string `json:"prefix"`
+	MaxUses int    `json:"max_uses"`
+	Uses    int    `json:"uses"`
+	Code    string `json:"code"`
+}
+
+func TestInvites(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	invitesURL := AppBaseURL
+	invitesURL.Path = "/auth/invites"
+	verifyURL := AppBaseURL
+	verifyURL.Path = "/auth/verify"
+
+	email := "inviter@gmail.com"
+	seen := len(MailsTo(t, email))
+	token := Register(ctx, t, email, "plum-Tractor-Velvet-42")
+
+	// only verified users may invite
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]int{"max_uses": 2}).
+		Post(invitesURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": LastMailToken(ctx, t, email, seen)}).
+		Post(verifyURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	// the default limit for users who aren't admins is 5 uses
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]int{"max_uses": 50}).
+		Post(invitesURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	created := InviteResp{}
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]int{"max_uses": 2}).
+		SetResult(&created).
+		Post(invitesURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.NotEmpty(t, created.Code)
+	assert.Equal(t, 2, created.MaxUses)
+
+	list := make([]InviteResp, 0)
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetResult(&list).
+		Get(invitesURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, created.ID, list[0].ID)
+		assert.Empty(t, list[0].Code)
+	}
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		Delete(invitesURL.String() + "/" + strconv.FormatUint(created.ID, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		Delete(invitesURL.String() + "/" + strconv.FormatUint(created.ID, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+}
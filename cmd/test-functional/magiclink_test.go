@@ -0,0 +1,82 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMagicLink(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	requestURL := AppBaseURL
+	requestURL.Path = "/auth/magic-link"
+	consumeURL := AppBaseURL
+	consumeURL.Path = "/auth/magic-link/consume"
+
+	email := "magic@gmail.com"
+	seen := len(MailsTo(t, email))
+	Register(ctx, t, email, "plum-Tractor-Velvet-42")
+	// wait for the verification mail, so that it isn't taken for the login link
+	LastMailToken(ctx, t, email, seen)
+
+	resp, err := resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": email}).
+		Post(requestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	token := LastMailToken(ctx, t, email, seen+1)
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": email}).
+		Post(requestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": token}).
+		SetResult(&TokenResp{}).
+		Post(consumeURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.NotEmpty(t, resp.Result().(*TokenResp).Token)
+
+	var verified bool
+	err = DBConn.QueryRow(ctx, "SELECT email_verified_at IS NOT NULL FROM users WHERE email=$1", email).Scan(&verified)
+	assert.Nil(t, err)
+	assert.True(t, verified)
+
+	// links work once
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": token}).
+		Post(consumeURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	// addresses without an account get the same answers but no mail
+	unknown := "magic-unknown@gmail.com"
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": unknown}).
+		Post(requestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": unknown}).
+		Post(requestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+	assert.Empty(t, MailsTo(t, unknown))
+}
@@ -2,9 +2,14 @@ package test_functional
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,19 +19,27 @@ import (
 )
 
 var (
-	DBConn     *pgx.Conn
-	AppBaseURL url.URL
+	DBConn           *pgx.Conn
+	AppBaseURL       url.URL
+	MailLogFile      string
+	MockOIDCProvider *MockOIDC
 )
 
 type (
 	Config struct {
-		Host       string `mapstructure:"HOST"`
-		Port       string `mapstructure:"PORT"`
-		DBHost     string `mapstructure:"DB_HOST"`
-		DBPort     string `mapstructure:"DB_PORT"`
-		DBUser     string `mapstructure:"DB_USER"`
-		DBPassword string `mapstructure:"DB_PASSWORD"`
-		DBName     string `mapstructure:"DB_NAME"`
+		Host        string `mapstructure:"HOST"`
+		Port        string `mapstructure:"PORT"`
+		DBHost      string `mapstructure:"DB_HOST"`
+		DBPort      string `mapstructure:"DB_PORT"`
+		DBUser      string `mapstructure:"DB_USER"`
+		DBPassword  string `mapstructure:"DB_PASSWORD"`
+		DBName      string `mapstructure:"DB_NAME"`
+		MailLogFile string `mapstructure:"MAIL_LOG_FILE"`
+		// the app is configured to use the mock provider under these settings
+		OIDCListen       string `mapstructure:"OIDC_LISTEN"`
+		OIDCIssuer       string `mapstructure:"OIDC_ISSUER"`
+		OIDCClientID     string `mapstructure:"OIDC_CLIENT_ID"`
+		OIDCClientSecret string `mapstructure:"OIDC_CLIENT_SECRET"`
 	}
 )
 
@@ -40,8 +53,14 @@ func TestMain(m *testing.M) {
 	viper.SetDefault("DB_USER", "user")
 	viper.SetDefault("DB_PASSWORD", "password")
 	viper.SetDefault("DB_NAME", "db")
+	viper.SetDefault("MAIL_LOG_FILE", "/mail/outbox.jsonl")
+	viper.SetDefault("OIDC_LISTEN", ":8085")
+	viper.SetDefault("OIDC_ISSUER", "http://test-runner:8085")
+	viper.SetDefault("OIDC_CLIENT_ID", "bookmarker")
+	viper.SetDefault("OIDC_CLIENT_SECRET", "secret")
 
-	envs := []string{"HOST", "PORT", "DB_HOST", "DB_PORT", "DB_USER", "DB_PASSWORD", "DB_NAME"}
+	envs := []string{"HOST", "PORT", "DB_HOST", "DB_PORT", "DB_USER", "DB_PASSWORD", "DB_NAME", "MAIL_LOG_FILE",
+		"OIDC_LISTEN", "OIDC_ISSUER", "OIDC_CLIENT_ID", "OIDC_CLIENT_SECRET"}
 	for _, key := range envs {
 		if err := viper.BindEnv(key); err != nil {
 			panic(err)
@@ -56,6 +75,19 @@ func TestMain(m *testing.M) {
 
 	////////
 
+	mockOIDC, err := NewMockOIDC(cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret)
+	if err != nil {
+		panic(err)
+	}
+	MockOIDCProvider = mockOIDC
+	go func() {
+		if err := http.ListenAndServe(cfg.OIDCListen, mockOIDC.Handler()); err != nil {
+			panic(err)
+		}
+	}()
+
+	////////
+
 	pingCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 
 	cl := resty.New()
@@ -95,6 +127,7 @@ func TestMain(m *testing.M) {
 		panic(err)
 	}
 	DBConn = conn
+	MailLogFile = cfg.MailLogFile
 
 	/////////
 
@@ -114,7 +147,149 @@ func FlushDB() {
 	if _, err := DBConn.Exec(ctx, "DELETE from tags"); err != nil {
 		panic(err)
 	}
+	if _, err := DBConn.Exec(ctx, "DELETE from data_exports"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from invites"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from recovery_codes"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from user_identities"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from oidc_states"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from api_keys"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from login_throttles"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from one_time_tokens"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from refresh_tokens"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from sessions"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from revoked_sessions"); err != nil {
+		panic(err)
+	}
+	if _, err := DBConn.Exec(ctx, "DELETE from audit_events"); err != nil {
+		panic(err)
+	}
 	if _, err := DBConn.Exec(ctx, "DELETE from users"); err != nil {
 		panic(err)
 	}
 }
+
+type TokenResp struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Register creates a user through the API and returns its token.
+func Register(ctx context.Context, t *testing.T, email, password string) string {
+	u := AppBaseURL
+	u.Path = "/auth/register"
+
+	resp, err := resty.New().
+		R().
+		SetHeader("Content-Type", "application/json").
+		SetContext(ctx).
+		SetResult(&TokenResp{}).
+		SetBody(map[string]string{"email": email, "password": password}).
+		Post(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		t.Fatalf("register failed with status %d: %s", resp.StatusCode(), resp.String())
+	}
+	return resp.Result().(*TokenResp).Token
+}
+
+// Login logs an existing user in through the API and returns a new token.
+func Login(ctx context.Context, t *testing.T, email, password string) string {
+	u := AppBaseURL
+	u.Path = "/auth/login"
+
+	resp, err := resty.New().
+		R().
+		SetHeader("Content-Type", "application/json").
+		SetContext(ctx).
+		SetResult(&TokenResp{}).
+		SetBody(map[string]string{"email": email, "password": password}).
+		Post(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		t.Fatalf("login failed with status %d: %s", resp.StatusCode(), resp.String())
+	}
+	return resp.Result().(*TokenResp).Token
+}
+
+type Mail struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+var mailTokenRe = regexp.MustCompile(`token=([A-Za-z0-9_%-]+)`)
+
+// LastMailToken waits for a mail to the address which is newer than the given count
+// of mails and returns the token from the link in it.
+func LastMailToken(ctx context.Context, t *testing.T, to string, seen int) string {
+	for {
+		mails := MailsTo(t, to)
+		if len(mails) > seen {
+			m := mailTokenRe.FindStringSubmatch(mails[len(mails)-1].Body)
+			if m == nil {
+				t.Fatalf("no token in mail: %s", mails[len(mails)-1].Body)
+			}
+			token, err := url.QueryUnescape(m[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("no mail to %s arrived", to)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+// MailsTo returns every mail the app has sent to the address so far.
+func MailsTo(t *testing.T, to string) []Mail {
+	b, err := ioutil.ReadFile(MailLogFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		t.Fatal(err)
+	}
+
+	mails := make([]Mail, 0)
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		m := Mail{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.To == to {
+			mails = append(mails, m)
+		}
+	}
+	return mails
+}
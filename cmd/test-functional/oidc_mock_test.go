@@ -0,0 +1,208 @@
+package test_functional
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type (
+	// MockOIDC is a minimal OIDC provider the app signs users in with during the tests.
+	// It approves every authorization request as the account set with SignInAs.
+	MockOIDC struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		key          *rsa.PrivateKey
+
+		mu      sync.Mutex
+		account MockOIDCAccount
+		codes   map[string]mockOIDCCode
+	}
+
+	MockOIDCAccount struct {
+		Subject       string
+		Email         string
+		EmailVerified bool
+	}
+
+	mockOIDCCode struct {
+		account       MockOIDCAccount
+		clientID      string
+		redirectURI   string
+		nonce         string
+		codeChallenge string
+	}
+)
+
+func NewMockOIDC(issuer, clientID, clientSecret string) (*MockOIDC, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockOIDC{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		key:          key,
+		codes:        map[string]mockOIDCCode{},
+	}, nil
+}
+
+// SignInAs sets the account the following authorizations are approved as.
+func (m *MockOIDC) SignInAs(account MockOIDCAccount) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.account = account
+}
+
+func (m *MockOIDC) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	mux.HandleFunc("/jwks", m.jwks)
+	return mux
+}
+
+func (m *MockOIDC) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"issuer":                 m.issuer,
+		"authorization_endpoint": m.issuer + "/authorize",
+		"token_endpoint":         m.issuer + "/token",
+		"jwks_uri":               m.issuer + "/jwks",
+	})
+}
+
+func (m *MockOIDC) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+
+	m.mu.Lock()
+	m.codes[code] = mockOIDCCode{
+		account:       m.account,
+		clientID:      q.Get("client_id"),
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+	}
+	m.mu.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "bad redirect uri", http.StatusBadRequest)
+		return
+	}
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *MockOIDC) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != m.clientID || clientSecret != m.clientSecret {
+		http.Error(w, "bad client credentials", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	code, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	if !ok || code.clientID != clientID || code.redirectURI != r.PostForm.Get("redirect_uri") {
+		http.Error(w, "bad code", http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != code.codeChallenge {
+		http.Error(w, "bad code verifier", http.StatusBadRequest)
+		return
+	}
+
+	idToken, err := m.sign(map[string]interface{}{
+		"iss":            m.issuer,
+		"sub":            code.account.Subject,
+		"aud":            clientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          code.nonce,
+		"email":          code.account.Email,
+		"email_verified": code.account.EmailVerified,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func (m *MockOIDC) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (m *MockOIDC) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "mock"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
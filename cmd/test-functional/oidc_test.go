@@ -0,0 +1,246 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// OIDCSignIn walks the browser part of signing in with the mock provider
+// and returns the query the app finally redirected to the client app with.
+func OIDCSignIn(ctx context.Context, t *testing.T, account MockOIDCAccount) url.Values {
+	MockOIDCProvider.SignInAs(account)
+
+	browser := OIDCBrowser(t)
+	start := AppBaseURL
+	start.Path = "/auth/oidc/mock"
+	// app -> provider -> app -> client app
+	location := OIDCFollow(ctx, t, browser, start.String(), 3)
+	return OIDCClientQuery(t, location)
+}
+
+// OIDCBrowser is a client keeping cookies and stopping at redirects, like a browser one steps through.
+func OIDCBrowser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// OIDCFollow follows that many redirects from the location and returns the last one.
+func OIDCFollow(ctx context.Context, t *testing.T, browser *http.Client, location string, redirects int) string {
+	for i := 0; i < redirects; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := browser.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("expected a redirect from %s, got %d", location, resp.StatusCode)
+		}
+		location = resp.Header.Get("Location")
+	}
+	return location
+}
+
+// OIDCClientQuery returns the query of the redirect to the client app.
+func OIDCClientQuery(t *testing.T, location string) url.Values {
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/oidc/callback", u.Path)
+	return u.Query()
+}
+
+func OIDCExchange(ctx context.Context, t *testing.T, loginToken string) *resty.Response {
+	u := AppBaseURL
+	u.Path = "/auth/oidc/exchange"
+
+	resp, err := resty.New().R().
+		SetContext(ctx).
+		SetResult(&TokenResp{}).
+		SetBody(map[string]string{"token": loginToken}).
+		Post(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestOIDC(t *testing.T) {
+	t.Run("new user", func(t *testing.T) {
+		defer FlushDB()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+		defer cancel()
+
+		account := MockOIDCAccount{Subject: "subject-1", Email: "oidc@gmail.com", EmailVerified: true}
+
+		query := OIDCSignIn(ctx, t, account)
+		assert.Empty(t, query.Get("error"))
+		resp := OIDCExchange(ctx, t, query.Get("token"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.NotEmpty(t, resp.Result().(*TokenResp).Token)
+
+		// login tokens are single use
+		resp = OIDCExchange(ctx, t, query.Get("token"))
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+		// signing in again finds the same user
+		query = OIDCSignIn(ctx, t, account)
+		resp = OIDCExchange(ctx, t, query.Get("token"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+		var users int
+		err := DBConn.QueryRow(ctx, "SELECT count(*) FROM users WHERE email=$1 AND email_verified_at IS NOT NULL", account.Email).Scan(&users)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, users)
+	})
+
+	t.Run("callback in another browser", func(t *testing.T) {
+		defer FlushDB()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+		defer cancel()
+
+		MockOIDCProvider.SignInAs(MockOIDCAccount{Subject: "attacker", Email: "attacker@gmail.com", EmailVerified: true})
+		start := AppBaseURL
+		start.Path = "/auth/oidc/mock"
+		// the attacker stops at the callback link and has the victim open it
+		callback := OIDCFollow(ctx, t, OIDCBrowser(t), start.String(), 2)
+
+		query := OIDCClientQuery(t, OIDCFollow(ctx, t, OIDCBrowser(t), callback, 1))
+		assert.Equal(t, "state_invalid", query.Get("error"))
+		assert.Empty(t, query.Get("token"))
+	})
+
+	t.Run("account without password", func(t *testing.T) {
+		defer FlushDB()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+		defer cancel()
+
+		accountURL := AppBaseURL
+		accountURL.Path = "/auth/account"
+		emailURL := AppBaseURL
+		emailURL.Path = "/auth/email"
+		resetRequestURL := AppBaseURL
+		resetRequestURL.Path = "/auth/password/reset-request"
+		resetURL := AppBaseURL
+		resetURL.Path = "/auth/password/reset"
+		passwordURL := AppBaseURL
+		passwordURL.Path = "/auth/password"
+
+		account := MockOIDCAccount{Subject: "subject-4", Email: "no-password@gmail.com", EmailVerified: true}
+		query := OIDCSignIn(ctx, t, account)
+		resp := OIDCExchange(ctx, t, query.Get("token"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		token := resp.Result().(*TokenResp).Token
+
+		deleteAccount := func(password string) *resty.Response {
+			resp, err := resty.New().R().
+				SetHeader("x-token", token).
+				SetContext(ctx).
+				SetBody(map[string]string{"password": password}).
+				Delete(accountURL.String())
+			assert.Nil(t, err)
+			return resp
+		}
+
+		resp = deleteAccount("plum-Tractor-Velvet-42")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+		assert.Contains(t, resp.String(), "no password")
+
+		resp, err := resty.New().R().
+			SetHeader("x-token", token).
+			SetContext(ctx).
+			SetBody(map[string]string{"email": "other-address@gmail.com", "password": "plum-Tractor-Velvet-42"}).
+			Post(emailURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+		assert.Contains(t, resp.String(), "no password")
+
+		resp, err = resty.New().R().
+			SetHeader("x-token", token).
+			SetContext(ctx).
+			SetBody(map[string]string{"current_password": "plum-Tractor-Velvet-42", "new_password": "amber-Meadow-Whistle-18"}).
+			Post(passwordURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+		assert.Contains(t, resp.String(), "no password")
+
+		// a password reset sets the first password
+		seen := len(MailsTo(t, account.Email))
+		resp, err = resty.New().R().
+			SetContext(ctx).
+			SetBody(map[string]string{"email": account.Email}).
+			Post(resetRequestURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+		resp, err = resty.New().R().
+			SetContext(ctx).
+			SetBody(map[string]string{
+				"token":    LastMailToken(ctx, t, account.Email, seen),
+				"password": "plum-Tractor-Velvet-42",
+			}).
+			Post(resetURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+		// the reset logged every session out
+		token = Login(ctx, t, account.Email, "plum-Tractor-Velvet-42")
+		assert.Equal(t, http.StatusAccepted, deleteAccount("plum-Tractor-Velvet-42").StatusCode())
+	})
+
+	t.Run("links verified account", func(t *testing.T) {
+		defer FlushDB()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+		defer cancel()
+
+		email := "linked@gmail.com"
+		Register(ctx, t, email, "plum-Tractor-Velvet-42")
+
+		query := OIDCSignIn(ctx, t, MockOIDCAccount{Subject: "subject-2", Email: email, EmailVerified: true})
+		assert.Equal(t, "account_not_confirmed", query.Get("error"))
+
+		_, err := DBConn.Exec(ctx, "UPDATE users SET email_verified_at = now() WHERE email=$1", email)
+		assert.Nil(t, err)
+
+		query = OIDCSignIn(ctx, t, MockOIDCAccount{Subject: "subject-2", Email: email, EmailVerified: true})
+		resp := OIDCExchange(ctx, t, query.Get("token"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+		var identities int
+		err = DBConn.QueryRow(ctx, "SELECT count(*) FROM user_identities i JOIN users u ON u.id = i.user_id WHERE u.email=$1", email).Scan(&identities)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, identities)
+	})
+
+	t.Run("unverified provider email", func(t *testing.T) {
+		defer FlushDB()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+		defer cancel()
+
+		query := OIDCSignIn(ctx, t, MockOIDCAccount{Subject: "subject-3", Email: "unverified@gmail.com"})
+		assert.Equal(t, "email_not_verified", query.Get("error"))
+	})
+}
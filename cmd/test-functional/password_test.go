@@ -0,0 +1,319 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordChange(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	passwordURL := AppBaseURL
+	passwordURL.Path = "/auth/password"
+	tagURL := AppBaseURL
+	tagURL.Path = "/tag"
+	resetRequestURL := AppBaseURL
+	resetRequestURL.Path = "/auth/password/reset-request"
+	resetURL := AppBaseURL
+	resetURL.Path = "/auth/password/reset"
+
+	current := Register(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+	other := Login(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+
+	LastMailToken(ctx, t, "test@gmail.com", 0)
+	seen := len(MailsTo(t, "test@gmail.com"))
+	resp, err := resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": "test@gmail.com"}).
+		Post(resetRequestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	resetToken := LastMailToken(ctx, t, "test@gmail.com", seen)
+
+	// MAGIC_LINK_INTERVAL limits reset links too
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": "test@gmail.com"}).
+		Post(resetRequestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", current).
+		SetContext(ctx).
+		SetBody(map[string]string{"current_password": "wrong wrong wrong", "new_password": "quiet-Harbor-Lantern-97"}).
+		Post(passwordURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", current).
+		SetContext(ctx).
+		SetBody(map[string]string{"current_password": "plum-Tractor-Velvet-42", "new_password": "quiet-Harbor-Lantern-97"}).
+		Post(passwordURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", other).
+		SetContext(ctx).
+		Get(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", current).
+		SetContext(ctx).
+		Get(tagURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	// a reset link mailed before the change doesn't work anymore
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": resetToken, "password": "copper-Lake-Saddle-63"}).
+		Post(resetURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	Login(ctx, t, "test@gmail.com", "quiet-Harbor-Lantern-97")
+}
+
+func TestPasswordReset(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	requestURL := AppBaseURL
+	requestURL.Path = "/auth/password/reset-request"
+	resetURL := AppBaseURL
+	resetURL.Path = "/auth/password/reset"
+	magicLinkURL := AppBaseURL
+	magicLinkURL.Path = "/auth/magic-link"
+
+	email := "reset@gmail.com"
+	Register(ctx, t, email, "plum-Tractor-Velvet-42")
+	// the verification mail goes out in the background, wait for it so it isn't taken for a link below
+	LastMailToken(ctx, t, email, 0)
+	seen := len(MailsTo(t, email))
+
+	resp, err := resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": "nobody@gmail.com"}).
+		Post(requestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": email}).
+		Post(requestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	earlier := LastMailToken(ctx, t, email, seen)
+	seen++
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": email}).
+		Post(requestURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	token := LastMailToken(ctx, t, email, seen)
+	seen++
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": email}).
+		Post(magicLinkURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+	magicToken := LastMailToken(ctx, t, email, seen)
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": token, "password": "amber-Meadow-Whistle-18"}).
+		Post(resetURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	// the reset revokes the other links mailed before it
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": earlier, "password": "copper-Lake-Saddle-63"}).
+		Post(resetURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": magicToken}).
+		Post(magicLinkURL.String() + "/consume")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	// single use
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": token, "password": "copper-Lake-Saddle-63"}).
+		Post(resetURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	Login(ctx, t, email, "amber-Meadow-Whistle-18")
+}
+
+func TestLoginLockout(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	loginURL := AppBaseURL
+	loginURL.Path = "/auth/login"
+
+	Register(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+
+	// LOGIN_ACCOUNT_MAX_FAILURES defaults to 5
+	for i := 0; i < 5; i++ {
+		resp, err := resty.New().R().
+			SetContext(ctx).
+			SetBody(map[string]string{"email": "test@gmail.com", "password": "wrong password"}).
+			Post(loginURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+	}
+
+	resp, err := resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": "test@gmail.com", "password": "plum-Tractor-Velvet-42"}).
+		Post(loginURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+	assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+}
+
+func TestPasswordChangeLockout(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	passwordURL := AppBaseURL
+	passwordURL.Path = "/auth/password"
+
+	token := Register(ctx, t, "test@gmail.com", "plum-Tractor-Velvet-42")
+
+	changePassword := func(current string) *resty.Response {
+		resp, err := resty.New().R().
+			SetHeader("x-token", token).
+			SetContext(ctx).
+			SetBody(map[string]string{"current_password": current, "new_password": "quiet-Harbor-Lantern-97"}).
+			Post(passwordURL.String())
+		assert.Nil(t, err)
+		return resp
+	}
+
+	// LOGIN_ACCOUNT_MAX_FAILURES defaults to 5
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusForbidden, changePassword("wrong password").StatusCode())
+	}
+
+	resp := changePassword("plum-Tractor-Velvet-42")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+	assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+}
+
+func TestPasswordRehash(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	email := "rehash@gmail.com"
+	Register(ctx, t, email, "plum-Tractor-Velvet-42")
+
+	var hash string
+	err := DBConn.QueryRow(ctx, "SELECT password FROM users WHERE email=$1", email).Scan(&hash)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$"))
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("plum-Tractor-Velvet-42"), 10)
+	assert.Nil(t, err)
+	_, err = DBConn.Exec(ctx, "UPDATE users SET password=$1 WHERE email=$2", string(legacy), email)
+	assert.Nil(t, err)
+
+	Login(ctx, t, email, "plum-Tractor-Velvet-42")
+
+	err = DBConn.QueryRow(ctx, "SELECT password FROM users WHERE email=$1", email).Scan(&hash)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$"))
+
+	Login(ctx, t, email, "plum-Tractor-Velvet-42")
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	registerURL := AppBaseURL
+	registerURL.Path = "/auth/register"
+	passwordURL := AppBaseURL
+	passwordURL.Path = "/auth/password"
+
+	type Rejected struct {
+		Reasons []struct {
+			Code string `json:"code"`
+		} `json:"reasons"`
+	}
+	codes := func(r *Rejected) []string {
+		codes := make([]string, 0)
+		for _, reason := range r.Reasons {
+			codes = append(codes, reason.Code)
+		}
+		return codes
+	}
+
+	resp, err := resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": "policy@gmail.com", "password": "111111111111"}).
+		SetError(&Rejected{}).
+		Post(registerURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Equal(t, []string{"common", "too_weak"}, codes(resp.Error().(*Rejected)))
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"email": "policy@gmail.com", "password": "policy-Velvet-42"}).
+		SetError(&Rejected{}).
+		Post(registerURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Equal(t, []string{"contains_email"}, codes(resp.Error().(*Rejected)))
+
+	token := Register(ctx, t, "policy@gmail.com", "plum-Tractor-Velvet-42")
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"current_password": "plum-Tractor-Velvet-42", "new_password": "short"}).
+		SetError(&Rejected{}).
+		Post(passwordURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Equal(t, []string{"too_short", "too_weak"}, codes(resp.Error().(*Rejected)))
+}
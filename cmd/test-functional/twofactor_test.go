@@ -0,0 +1,199 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/totp"
+)
+
+type TwoFactorChallengeResp struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+func TestTwoFactor(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	enrollURL := AppBaseURL
+	enrollURL.Path = "/auth/2fa/enroll"
+	confirmURL := AppBaseURL
+	confirmURL.Path = "/auth/2fa/confirm"
+	disableURL := AppBaseURL
+	disableURL.Path = "/auth/2fa/disable"
+	loginURL := AppBaseURL
+	loginURL.Path = "/auth/login"
+	secondFactorURL := AppBaseURL
+	secondFactorURL.Path = "/auth/login/2fa"
+
+	email := "twofactor@gmail.com"
+	password := "plum-Tractor-Velvet-42"
+	token := Register(ctx, t, email, password)
+
+	enroll := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{}
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetResult(&enroll).
+		Post(enrollURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.NotEmpty(t, enroll.Secret)
+
+	step := time.Now().Unix() / 30
+	code, err := totp.Code(enroll.Secret, step)
+	assert.Nil(t, err)
+
+	confirm := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"code": code}).
+		SetResult(&confirm).
+		Post(confirmURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Len(t, confirm.RecoveryCodes, 10)
+
+	login := func() string {
+		challenge := TwoFactorChallengeResp{}
+		resp, err := resty.New().R().
+			SetContext(ctx).
+			SetBody(map[string]string{"email": email, "password": password}).
+			SetResult(&challenge).
+			Post(loginURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.True(t, challenge.TwoFactorRequired)
+		return challenge.ChallengeToken
+	}
+
+	// The code used to confirm can't be used again.
+	challenge := login()
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"challenge_token": challenge, "code": code}).
+		Post(secondFactorURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	next, err := totp.Code(enroll.Secret, step+1)
+	assert.Nil(t, err)
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"challenge_token": challenge, "code": next}).
+		SetResult(&TokenResp{}).
+		Post(secondFactorURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.NotEmpty(t, resp.Result().(*TokenResp).Token)
+
+	// A challenge is single-use.
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"challenge_token": challenge, "recovery_code": confirm.RecoveryCodes[0]}).
+		Post(secondFactorURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode())
+
+	challenge = login()
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"challenge_token": challenge, "recovery_code": confirm.RecoveryCodes[0]}).
+		SetResult(&TokenResp{}).
+		Post(secondFactorURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"recovery_code": confirm.RecoveryCodes[0]}).
+		Post(disableURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"recovery_code": confirm.RecoveryCodes[1]}).
+		Post(disableURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	Login(ctx, t, email, password)
+}
+
+func TestTwoFactorDisableLockout(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	enrollURL := AppBaseURL
+	enrollURL.Path = "/auth/2fa/enroll"
+	confirmURL := AppBaseURL
+	confirmURL.Path = "/auth/2fa/confirm"
+	disableURL := AppBaseURL
+	disableURL.Path = "/auth/2fa/disable"
+
+	token := Register(ctx, t, "twofactor@gmail.com", "plum-Tractor-Velvet-42")
+
+	enroll := struct {
+		Secret string `json:"secret"`
+	}{}
+	resp, err := resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetResult(&enroll).
+		Post(enrollURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	code, err := totp.Code(enroll.Secret, time.Now().Unix()/30)
+	assert.Nil(t, err)
+	confirm := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"code": code}).
+		SetResult(&confirm).
+		Post(confirmURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	// LOGIN_ACCOUNT_MAX_FAILURES defaults to 5
+	for i := 0; i < 5; i++ {
+		resp, err = resty.New().R().
+			SetHeader("x-token", token).
+			SetContext(ctx).
+			SetBody(map[string]string{"recovery_code": "wrong-code"}).
+			Post(disableURL.String())
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode())
+	}
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", token).
+		SetContext(ctx).
+		SetBody(map[string]string{"recovery_code": confirm.RecoveryCodes[0]}).
+		Post(disableURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+	assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+}
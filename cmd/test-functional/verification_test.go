@@ -0,0 +1,55 @@
+package test_functional
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailVerification(t *testing.T) {
+	defer FlushDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+
+	verifyURL := AppBaseURL
+	verifyURL.Path = "/auth/verify"
+	resendURL := AppBaseURL
+	resendURL.Path = "/auth/verify/resend"
+
+	email := "verify@gmail.com"
+	seen := len(MailsTo(t, email))
+	accessToken := Register(ctx, t, email, "plum-Tractor-Velvet-42")
+	token := LastMailToken(ctx, t, email, seen)
+
+	// the registration mail was just sent
+	resp, err := resty.New().R().
+		SetHeader("x-token", accessToken).
+		SetContext(ctx).
+		Post(resendURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetContext(ctx).
+		SetBody(map[string]string{"token": token}).
+		Post(verifyURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode())
+
+	var verified bool
+	err = DBConn.QueryRow(ctx, "SELECT email_verified_at IS NOT NULL FROM users WHERE email=$1", email).Scan(&verified)
+	assert.Nil(t, err)
+	assert.True(t, verified)
+
+	resp, err = resty.New().R().
+		SetHeader("x-token", accessToken).
+		SetContext(ctx).
+		Post(resendURL.String())
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode())
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
@@ -10,6 +12,20 @@ import (
 const (
 	sslModeDisable = "disable"
 	sslModeRequire = "require"
+
+	UnverifiedAccessFull     = "full"
+	UnverifiedAccessReadOnly = "read_only"
+	UnverifiedAccessGrace    = "grace"
+
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+
+	// insecureDevelopmentKey used to be the default secret, so it is public and must not be used.
+	insecureDevelopmentKey = "insecure-development-key"
 )
 
 type (
@@ -22,6 +38,110 @@ type (
 		DBPassword string `mapstructure:"DB_PASSWORD"`
 		DBName     string `mapstructure:"DB_NAME"`
 		DBSSLMode  string `mapstructure:"DB_SSL_MODE"`
+		// ProxyHeader is the header the reverse proxy puts the client IP into, e.g. X-Forwarded-For on Heroku.
+		// Leave it empty when there is no proxy, otherwise clients can spoof their IP.
+		ProxyHeader string `mapstructure:"PROXY_HEADER"`
+
+		// AuthSigningKeys is a comma separated list of "key id:secret" pairs used to verify access tokens.
+		// Keeping retired keys in the list lets tokens signed with them live until they expire.
+		AuthSigningKeys string `mapstructure:"AUTH_SIGNING_KEYS"`
+		// AuthSigningKeyID selects the key from AuthSigningKeys used to sign new access tokens.
+		AuthSigningKeyID string        `mapstructure:"AUTH_SIGNING_KEY_ID"`
+		AccessTokenTTL   time.Duration `mapstructure:"ACCESS_TOKEN_TTL"`
+		RefreshTokenTTL  time.Duration `mapstructure:"REFRESH_TOKEN_TTL"`
+		// TokenHashKey keys the hash opaque tokens are stored under. Changing it invalidates all of them.
+		TokenHashKey string `mapstructure:"TOKEN_HASH_KEY"`
+
+		// PasswordHashAlgorithm is what new password hashes are made with, "argon2id" or "bcrypt".
+		// Hashes made with another algorithm or other parameters are upgraded when their owner logs in.
+		PasswordHashAlgorithm string `mapstructure:"PASSWORD_HASH_ALGORITHM"`
+		// Argon2Memory is in KiB.
+		Argon2Memory      uint32 `mapstructure:"ARGON2_MEMORY"`
+		Argon2Iterations  uint32 `mapstructure:"ARGON2_ITERATIONS"`
+		Argon2Parallelism uint8  `mapstructure:"ARGON2_PARALLELISM"`
+		BcryptCost        int    `mapstructure:"BCRYPT_COST"`
+
+		// New passwords must be PasswordMinLength characters long, have an estimated PasswordMinEntropy bits
+		// of entropy and not be on the list of common passwords, extended with PasswordBlocklistFile.
+		PasswordMinLength     int     `mapstructure:"PASSWORD_MIN_LENGTH"`
+		PasswordMinEntropy    float64 `mapstructure:"PASSWORD_MIN_ENTROPY"`
+		PasswordBlocklistFile string  `mapstructure:"PASSWORD_BLOCKLIST_FILE"`
+
+		// PublicURL is where the client app lives; links in emails point there.
+		PublicURL string `mapstructure:"PUBLIC_URL"`
+		// APIURL is where this server is reachable from browsers, OIDC providers redirect back there.
+		APIURL           string        `mapstructure:"API_URL"`
+		PasswordResetTTL time.Duration `mapstructure:"PASSWORD_RESET_TTL"`
+
+		// A magic link logs in whoever opens it within MagicLinkTTL. At most one is sent
+		// to an address per MagicLinkInterval, whether it has an account or not.
+		// Password reset links are limited by the same interval.
+		MagicLinkTTL      time.Duration `mapstructure:"MAGIC_LINK_TTL"`
+		MagicLinkInterval time.Duration `mapstructure:"MAGIC_LINK_INTERVAL"`
+
+		EmailVerificationTTL            time.Duration `mapstructure:"EMAIL_VERIFICATION_TTL"`
+		EmailVerificationResendInterval time.Duration `mapstructure:"EMAIL_VERIFICATION_RESEND_INTERVAL"`
+		// UnverifiedAccess is what accounts with an unverified email may do: "full" access, "read_only" access
+		// or "grace", which is full access for UnverifiedGracePeriod after registration and read only afterwards.
+		UnverifiedAccess      string        `mapstructure:"UNVERIFIED_ACCESS"`
+		UnverifiedGracePeriod time.Duration `mapstructure:"UNVERIFIED_GRACE_PERIOD"`
+
+		// Failed logins are counted per account and per IP. Once a counter reaches its maximum
+		// the account or IP is locked out for LoginLockoutBase, doubled with every further failure
+		// up to LoginLockoutMax. Counters start over after LoginFailureWindow without failures.
+		LoginAccountMaxFailures int           `mapstructure:"LOGIN_ACCOUNT_MAX_FAILURES"`
+		LoginIPMaxFailures      int           `mapstructure:"LOGIN_IP_MAX_FAILURES"`
+		LoginLockoutBase        time.Duration `mapstructure:"LOGIN_LOCKOUT_BASE"`
+		LoginLockoutMax         time.Duration `mapstructure:"LOGIN_LOCKOUT_MAX"`
+		LoginFailureWindow      time.Duration `mapstructure:"LOGIN_FAILURE_WINDOW"`
+
+		// RegistrationMode is who may sign up: anyone ("open"), only with an invite code ("invite") or nobody
+		// ("closed"). Signing in with an OIDC provider only creates accounts in open mode.
+		RegistrationMode string `mapstructure:"REGISTRATION_MODE"`
+		// Invites made by users who aren't admins are limited to InviteMaxUses uses and InviteTTL,
+		// which is also the lifetime of invites if none is asked for.
+		InviteTTL     time.Duration `mapstructure:"INVITE_TTL"`
+		InviteMaxUses int           `mapstructure:"INVITE_MAX_USES"`
+
+		// AdminEmails is a comma separated list of accounts made admins once their email is verified.
+		AdminEmails string `mapstructure:"ADMIN_EMAILS"`
+		// UserAccessSyncInterval is how often the disabled accounts and revoked sessions are reloaded from the
+		// database, which is how changes made through another instance take effect on this one.
+		UserAccessSyncInterval time.Duration `mapstructure:"USER_ACCESS_SYNC_INTERVAL"`
+
+		// AccountDeletionGracePeriod is how long a deleted account can still be restored before it is purged
+		// with all its data. Zero purges it right away.
+		AccountDeletionGracePeriod time.Duration `mapstructure:"ACCOUNT_DELETION_GRACE_PERIOD"`
+		// AccountPurgeInterval is how often accounts past their grace period are looked for.
+		AccountPurgeInterval time.Duration `mapstructure:"ACCOUNT_PURGE_INTERVAL"`
+
+		// DataExportTTL is how long a finished data export can be downloaded, DataExportLinkTTL is how long
+		// a single download link stays valid. Pending exports are picked up every DataExportInterval.
+		DataExportTTL      time.Duration `mapstructure:"DATA_EXPORT_TTL"`
+		DataExportLinkTTL  time.Duration `mapstructure:"DATA_EXPORT_LINK_TTL"`
+		DataExportInterval time.Duration `mapstructure:"DATA_EXPORT_INTERVAL"`
+
+		// OIDCProviderNames is a comma separated list of OIDC providers users can sign in with.
+		// Each one is configured with OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and _SCOPES.
+		OIDCProviderNames string               `mapstructure:"OIDC_PROVIDERS"`
+		OIDCProviders     []OIDCProviderConfig `mapstructure:"-"`
+
+		// Mailer is either "log" or "smtp".
+		Mailer        string `mapstructure:"MAILER"`
+		MailerLogFile string `mapstructure:"MAILER_LOG_FILE"`
+		MailFrom      string `mapstructure:"MAIL_FROM"`
+		SMTPHost      string `mapstructure:"SMTP_HOST"`
+		SMTPPort      string `mapstructure:"SMTP_PORT"`
+		SMTPUser      string `mapstructure:"SMTP_USER"`
+		SMTPPassword  string `mapstructure:"SMTP_PASSWORD"`
+	}
+
+	OIDCProviderConfig struct {
+		Name         string
+		Issuer       string
+		ClientID     string
+		ClientSecret string
+		Scopes       []string
 	}
 )
 
@@ -36,8 +156,62 @@ func NewConfig() (*Config, error) {
 	viper.SetDefault("DB_PASSWORD", "password")
 	viper.SetDefault("DB_NAME", "db")
 	viper.SetDefault("DB_SSL_MODE", sslModeDisable)
+	viper.SetDefault("PROXY_HEADER", "")
+	viper.SetDefault("AUTH_SIGNING_KEY_ID", "dev")
+	viper.SetDefault("ACCESS_TOKEN_TTL", "15m")
+	viper.SetDefault("REFRESH_TOKEN_TTL", "720h")
+	viper.SetDefault("PASSWORD_HASH_ALGORITHM", PasswordHashArgon2id)
+	viper.SetDefault("ARGON2_MEMORY", 19456)
+	viper.SetDefault("ARGON2_ITERATIONS", 2)
+	viper.SetDefault("ARGON2_PARALLELISM", 1)
+	viper.SetDefault("BCRYPT_COST", 12)
+	viper.SetDefault("PASSWORD_MIN_LENGTH", 12)
+	viper.SetDefault("PASSWORD_MIN_ENTROPY", 50)
+	viper.SetDefault("PASSWORD_BLOCKLIST_FILE", "")
+	viper.SetDefault("PUBLIC_URL", "http://localhost:1323")
+	viper.SetDefault("API_URL", "http://localhost:1323")
+	viper.SetDefault("OIDC_PROVIDERS", "")
+	viper.SetDefault("PASSWORD_RESET_TTL", "1h")
+	viper.SetDefault("MAGIC_LINK_TTL", "15m")
+	viper.SetDefault("MAGIC_LINK_INTERVAL", "1m")
+	viper.SetDefault("EMAIL_VERIFICATION_TTL", "48h")
+	viper.SetDefault("EMAIL_VERIFICATION_RESEND_INTERVAL", "5m")
+	viper.SetDefault("UNVERIFIED_ACCESS", UnverifiedAccessGrace)
+	viper.SetDefault("UNVERIFIED_GRACE_PERIOD", "72h")
+	viper.SetDefault("LOGIN_ACCOUNT_MAX_FAILURES", 5)
+	viper.SetDefault("LOGIN_IP_MAX_FAILURES", 20)
+	viper.SetDefault("LOGIN_LOCKOUT_BASE", "1m")
+	viper.SetDefault("LOGIN_LOCKOUT_MAX", "1h")
+	viper.SetDefault("LOGIN_FAILURE_WINDOW", "1h")
+	viper.SetDefault("REGISTRATION_MODE", RegistrationOpen)
+	viper.SetDefault("INVITE_TTL", "168h")
+	viper.SetDefault("INVITE_MAX_USES", 5)
+	viper.SetDefault("ADMIN_EMAILS", "")
+	viper.SetDefault("USER_ACCESS_SYNC_INTERVAL", "30s")
+	viper.SetDefault("ACCOUNT_DELETION_GRACE_PERIOD", "168h")
+	viper.SetDefault("ACCOUNT_PURGE_INTERVAL", "10m")
+	viper.SetDefault("DATA_EXPORT_TTL", "24h")
+	viper.SetDefault("DATA_EXPORT_LINK_TTL", "1h")
+	viper.SetDefault("DATA_EXPORT_INTERVAL", "1m")
+	viper.SetDefault("MAILER", "log")
+	viper.SetDefault("MAILER_LOG_FILE", "")
+	viper.SetDefault("MAIL_FROM", "bookmarker@localhost")
+	viper.SetDefault("SMTP_HOST", "localhost")
+	viper.SetDefault("SMTP_PORT", "587")
+	viper.SetDefault("SMTP_USER", "")
+	viper.SetDefault("SMTP_PASSWORD", "")
 
-	envs := []string{"HOST", "PORT", "DB_HOST", "DB_PORT", "DB_USER", "DB_PASSWORD", "DB_NAME", "DB_SSL_MODE"}
+	envs := []string{"HOST", "PORT", "DB_HOST", "DB_PORT", "DB_USER", "DB_PASSWORD", "DB_NAME", "DB_SSL_MODE", "PROXY_HEADER",
+		"AUTH_SIGNING_KEYS", "AUTH_SIGNING_KEY_ID", "ACCESS_TOKEN_TTL", "REFRESH_TOKEN_TTL", "TOKEN_HASH_KEY",
+		"PASSWORD_HASH_ALGORITHM", "ARGON2_MEMORY", "ARGON2_ITERATIONS", "ARGON2_PARALLELISM", "BCRYPT_COST",
+		"PASSWORD_MIN_LENGTH", "PASSWORD_MIN_ENTROPY", "PASSWORD_BLOCKLIST_FILE",
+		"PUBLIC_URL", "API_URL", "PASSWORD_RESET_TTL", "OIDC_PROVIDERS", "MAGIC_LINK_TTL", "MAGIC_LINK_INTERVAL",
+		"EMAIL_VERIFICATION_TTL", "EMAIL_VERIFICATION_RESEND_INTERVAL", "UNVERIFIED_ACCESS", "UNVERIFIED_GRACE_PERIOD",
+		"LOGIN_ACCOUNT_MAX_FAILURES", "LOGIN_IP_MAX_FAILURES", "LOGIN_LOCKOUT_BASE", "LOGIN_LOCKOUT_MAX", "LOGIN_FAILURE_WINDOW",
+		"REGISTRATION_MODE", "INVITE_TTL", "INVITE_MAX_USES",
+		"ADMIN_EMAILS", "USER_ACCESS_SYNC_INTERVAL", "ACCOUNT_DELETION_GRACE_PERIOD", "ACCOUNT_PURGE_INTERVAL",
+		"DATA_EXPORT_TTL", "DATA_EXPORT_LINK_TTL", "DATA_EXPORT_INTERVAL",
+		"MAILER", "MAILER_LOG_FILE", "MAIL_FROM", "SMTP_HOST", "SMTP_PORT", "SMTP_USER", "SMTP_PASSWORD"}
 	for _, key := range envs {
 		if err := viper.BindEnv(key); err != nil {
 			return nil, err
@@ -49,6 +223,12 @@ func NewConfig() (*Config, error) {
 		return nil, err
 	}
 
+	providers, err := oidcProviders(cfg.OIDCProviderNames)
+	if err != nil {
+		return nil, errors.Wrap(err, "oidc providers")
+	}
+	cfg.OIDCProviders = providers
+
 	if err := validate(&cfg); err != nil {
 		return nil, errors.Wrap(err, "config validation failed")
 	}
@@ -56,7 +236,149 @@ func NewConfig() (*Config, error) {
 	return &cfg, nil
 }
 
+// oidcProviders reads the settings of every listed OIDC provider from OIDC_<NAME>_* variables.
+func oidcProviders(names string) ([]OIDCProviderConfig, error) {
+	providers := make([]OIDCProviderConfig, 0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		viper.SetDefault(prefix+"SCOPES", "openid email profile")
+		for _, key := range []string{"ISSUER", "CLIENT_ID", "CLIENT_SECRET", "SCOPES"} {
+			if err := viper.BindEnv(prefix + key); err != nil {
+				return nil, err
+			}
+		}
+
+		p := OIDCProviderConfig{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(viper.GetString(prefix+"ISSUER"), "/"),
+			ClientID:     viper.GetString(prefix + "CLIENT_ID"),
+			ClientSecret: viper.GetString(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(viper.GetString(prefix + "SCOPES")),
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			return nil, errors.New(fmt.Sprintf("%sISSUER and %sCLIENT_ID are required", prefix, prefix))
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// Admins returns the normalized addresses listed in AdminEmails.
+func (c *Config) Admins() []string {
+	admins := make([]string, 0)
+	for _, email := range strings.Split(c.AdminEmails, ",") {
+		email = strings.TrimSpace(strings.ToLower(email))
+		if email != "" {
+			admins = append(admins, email)
+		}
+	}
+	return admins
+}
+
+// SigningKeys parses AuthSigningKeys into a key id to secret map.
+func (c *Config) SigningKeys() (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	for _, pair := range strings.Split(c.AuthSigningKeys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New(fmt.Sprintf("signing key must look like 'id:secret': %s", parts[0]))
+		}
+		keys[parts[0]] = []byte(parts[1])
+	}
+	return keys, nil
+}
+
 func validate(cfg *Config) error {
+	if err := validateSSLMode(cfg); err != nil {
+		return err
+	}
+
+	keys, err := cfg.SigningKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("signing keys are not set")
+	}
+	for id, secret := range keys {
+		if string(secret) == insecureDevelopmentKey {
+			return errors.New(fmt.Sprintf("signing key is the public development one: %s", id))
+		}
+	}
+	if _, ok := keys[cfg.AuthSigningKeyID]; !ok {
+		return errors.New(fmt.Sprintf("signing key id is not in the key list: %s", cfg.AuthSigningKeyID))
+	}
+	if cfg.AccessTokenTTL <= 0 || cfg.RefreshTokenTTL <= 0 {
+		return errors.New("token TTLs must be positive")
+	}
+	if cfg.TokenHashKey == "" {
+		return errors.New("token hash key is not set")
+	}
+	if cfg.TokenHashKey == insecureDevelopmentKey {
+		return errors.New("token hash key is the public development one")
+	}
+	switch cfg.PasswordHashAlgorithm {
+	case PasswordHashArgon2id, PasswordHashBcrypt:
+	default:
+		return errors.New(fmt.Sprintf("password hash algorithm is invalid: %s", cfg.PasswordHashAlgorithm))
+	}
+	if cfg.Argon2Memory == 0 || cfg.Argon2Iterations == 0 || cfg.Argon2Parallelism == 0 {
+		return errors.New("argon2 parameters must be positive")
+	}
+	if cfg.BcryptCost < 4 || cfg.BcryptCost > 31 {
+		return errors.New("bcrypt cost must be between 4 and 31")
+	}
+	if cfg.PasswordMinLength <= 0 || cfg.PasswordMinEntropy < 0 {
+		return errors.New("password minimum length must be positive and minimum entropy not negative")
+	}
+	if cfg.PasswordResetTTL <= 0 || cfg.EmailVerificationTTL <= 0 || cfg.MagicLinkTTL <= 0 {
+		return errors.New("emailed token TTLs must be positive")
+	}
+	if cfg.MagicLinkInterval < 0 {
+		return errors.New("magic link interval must not be negative")
+	}
+	if cfg.LoginAccountMaxFailures <= 0 || cfg.LoginIPMaxFailures <= 0 {
+		return errors.New("login failure limits must be positive")
+	}
+	if cfg.LoginLockoutBase <= 0 || cfg.LoginLockoutMax < cfg.LoginLockoutBase {
+		return errors.New("login lockout must be positive and not exceed its maximum")
+	}
+	switch cfg.RegistrationMode {
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+	default:
+		return errors.New(fmt.Sprintf("registration mode is invalid: %s", cfg.RegistrationMode))
+	}
+	if cfg.InviteTTL <= 0 || cfg.InviteMaxUses <= 0 {
+		return errors.New("invite TTL and maximum uses must be positive")
+	}
+	if cfg.UserAccessSyncInterval <= 0 {
+		return errors.New("user access sync interval must be positive")
+	}
+	if cfg.AccountDeletionGracePeriod < 0 || cfg.AccountPurgeInterval <= 0 {
+		return errors.New("account deletion grace period must not be negative and purge interval must be positive")
+	}
+	if cfg.DataExportTTL <= 0 || cfg.DataExportLinkTTL <= 0 || cfg.DataExportInterval <= 0 {
+		return errors.New("data export TTLs and interval must be positive")
+	}
+	switch cfg.UnverifiedAccess {
+	case UnverifiedAccessFull, UnverifiedAccessReadOnly, UnverifiedAccessGrace:
+	default:
+		return errors.New(fmt.Sprintf("unverified access mode is invalid: %s", cfg.UnverifiedAccess))
+	}
+
+	return nil
+}
+
+func validateSSLMode(cfg *Config) error {
 	validSSLValues := []string{sslModeDisable, sslModeRequire}
 	for _, validValue := range validSSLValues {
 		if cfg.DBSSLMode == validValue {
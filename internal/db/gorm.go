@@ -12,6 +12,7 @@ import (
 	"gorm.io/gorm/logger"
 
 	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/token"
 )
 
 type (
@@ -23,11 +24,151 @@ type (
 
 	User struct {
 		GormForkedModel
-		Email     string `gorm:"unique;not null"`
-		Password  string `gorm:"not null"`
-		Token     string `gorm:"not null"`
-		Bookmarks []Bookmark
-		Tags      []Tag
+		Email           string `gorm:"unique;not null"`
+		Password        string `gorm:"not null"`
+		EmailVerifiedAt *time.Time
+		Role            string `gorm:"not null;default:user"`
+		// DisabledAt is set while an admin keeps the user from logging in.
+		DisabledAt *time.Time
+		// TOTPSecret is set on enrollment, two-factor authentication is on once TOTPEnabledAt is set too.
+		TOTPSecret    string
+		TOTPEnabledAt *time.Time
+		// TOTPLastStep is the time step of the last accepted code, a code can't be used twice.
+		TOTPLastStep int64
+		// DeletionScheduledAt is when the account is going to be purged, nil unless the user deleted it.
+		DeletionScheduledAt *time.Time `gorm:"index"`
+		Bookmarks           []Bookmark
+		Tags                []Tag
+		Sessions            []Session
+	}
+
+	Session struct {
+		GormForkedModel
+		UserAgent     string
+		IP            string
+		LastUsedAt    time.Time
+		UserID        uint64 `gorm:"not null;index"`
+		User          User
+		RefreshTokens []RefreshToken
+	}
+
+	// RevokedSession keeps a deleted session known until the access tokens issued for it expire, so that every
+	// instance refuses them. There is no foreign key as the session row is gone.
+	RevokedSession struct {
+		SessionID uint64    `gorm:"primarykey;autoIncrement:false"`
+		ExpiresAt time.Time `gorm:"not null;index"`
+	}
+
+	// RefreshToken is single-use: refreshing marks it used and issues a successor in the same session,
+	// so a used token showing up again means it leaked.
+	RefreshToken struct {
+		GormForkedModel
+		TokenHash   string `gorm:"uniqueIndex;not null"`
+		TokenPrefix string
+		ExpiresAt   time.Time
+		UsedAt      *time.Time
+		SessionID   uint64  `gorm:"not null;index"`
+		Session     Session `gorm:"constraint:OnDelete:CASCADE;"`
+	}
+
+	// OneTimeToken is a single-use secret sent to the user by email, e.g. to reset the password.
+	OneTimeToken struct {
+		GormForkedModel
+		TokenHash string `gorm:"uniqueIndex;not null"`
+		Kind      string `gorm:"not null"`
+		// Payload is data specific to the kind, e.g. the new address of an email change.
+		Payload   string
+		ExpiresAt time.Time
+		UsedAt    *time.Time
+		UserID    uint64 `gorm:"not null;index"`
+		User      User   `gorm:"constraint:OnDelete:CASCADE;"`
+	}
+
+	// APIKey is a long-lived credential for scripts, limited to its space separated scopes.
+	APIKey struct {
+		GormForkedModel
+		Name        string `gorm:"not null"`
+		TokenHash   string `gorm:"uniqueIndex;not null"`
+		TokenPrefix string
+		Scopes      string `gorm:"not null"`
+		LastUsedAt  *time.Time
+		UserID      uint64 `gorm:"not null;index"`
+		User        User   `gorm:"constraint:OnDelete:CASCADE;"`
+	}
+
+	// Invite lets up to MaxUses people register while registration is invite only.
+	Invite struct {
+		GormForkedModel
+		CodeHash   string `gorm:"uniqueIndex;not null"`
+		CodePrefix string
+		MaxUses    int       `gorm:"not null"`
+		Uses       int       `gorm:"not null;default:0"`
+		ExpiresAt  time.Time `gorm:"not null"`
+		UserID     uint64    `gorm:"not null;index"`
+		User       User      `gorm:"constraint:OnDelete:CASCADE;"`
+	}
+
+	// RecoveryCode is a single-use replacement for a TOTP code.
+	RecoveryCode struct {
+		GormForkedModel
+		CodeHash string `gorm:"not null;index"`
+		UsedAt   *time.Time
+		UserID   uint64 `gorm:"not null;index"`
+		User     User   `gorm:"constraint:OnDelete:CASCADE;"`
+	}
+
+	// DataExport is a zip archive of everything stored about a user, built in the background.
+	DataExport struct {
+		GormForkedModel
+		Status    string `gorm:"not null"`
+		Archive   []byte
+		ExpiresAt *time.Time
+		UserID    uint64 `gorm:"not null;index"`
+		User      User   `gorm:"constraint:OnDelete:CASCADE;"`
+	}
+
+	// UserIdentity links an account at an OIDC provider to a user.
+	UserIdentity struct {
+		GormForkedModel
+		Provider string `gorm:"not null;uniqueIndex:uidx_provider_subject"`
+		Subject  string `gorm:"not null;uniqueIndex:uidx_provider_subject"`
+		Email    string
+		UserID   uint64 `gorm:"not null;index"`
+		User     User   `gorm:"constraint:OnDelete:CASCADE;"`
+	}
+
+	// OIDCState remembers a sign in started at an OIDC provider until the browser comes back.
+	OIDCState struct {
+		GormForkedModel
+		State        string `gorm:"uniqueIndex;not null"`
+		Provider     string `gorm:"not null"`
+		CodeVerifier string `gorm:"not null"`
+		Nonce        string `gorm:"not null"`
+		ExpiresAt    time.Time
+	}
+
+	// LoginThrottle counts recent failed logins for an account or an IP, see LOGIN_* config.
+	LoginThrottle struct {
+		GormForkedModel
+		Key           string `gorm:"uniqueIndex;not null"`
+		Failures      int    `gorm:"not null"`
+		LastFailureAt time.Time
+		LockedUntil   *time.Time
+	}
+
+	// AuditEvent records a security-relevant action. Events are only ever inserted, so there is no UpdatedAt,
+	// and they outlive the users they are about.
+	AuditEvent struct {
+		ID        uint64    `gorm:"primarykey"`
+		CreatedAt time.Time `gorm:"index"`
+		Event     string    `gorm:"not null;index"`
+		Outcome   string    `gorm:"not null"`
+		// UserID is whose account the event is about, ActorID who caused it, which differs for admin actions.
+		UserID    *uint64 `gorm:"index"`
+		ActorID   *uint64
+		IP        string
+		UserAgent string
+		Details   string
 	}
 
 	Bookmark struct {
@@ -66,15 +207,141 @@ func NewGormClient(cfg *config.Config) (*gorm.DB, error) {
 		return nil, errors.Wrap(err, "failed to connect database")
 	}
 
+	// accounts created before email verification existed are trusted as they are
+	verifyExisting := db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "email_verified_at")
 	if err := db.AutoMigrate(&User{}); err != nil {
 		return nil, errors.Wrap(err, "migrate user")
 	}
+	if verifyExisting {
+		if res := db.Exec("UPDATE users SET email_verified_at = created_at"); res.Error != nil {
+			return nil, errors.Wrap(res.Error, "verify existing users")
+		}
+	}
 	if err := db.AutoMigrate(&Bookmark{}); err != nil {
 		return nil, errors.Wrap(err, "migrate bookmark")
 	}
+	if err := migrateBookmarkSearch(db); err != nil {
+		return nil, errors.Wrap(err, "migrate bookmark search")
+	}
 	if err := db.AutoMigrate(&Tag{}); err != nil {
 		return nil, errors.Wrap(err, "migrate tag")
 	}
+	if err := db.AutoMigrate(&Session{}); err != nil {
+		return nil, errors.Wrap(err, "migrate session")
+	}
+	if err := db.AutoMigrate(&RevokedSession{}); err != nil {
+		return nil, errors.Wrap(err, "migrate revoked session")
+	}
+	if err := hashLegacyRefreshTokens(db, cfg); err != nil {
+		return nil, errors.Wrap(err, "hash legacy refresh tokens")
+	}
+	if err := db.AutoMigrate(&RefreshToken{}); err != nil {
+		return nil, errors.Wrap(err, "migrate refresh token")
+	}
+	if err := db.AutoMigrate(&OneTimeToken{}); err != nil {
+		return nil, errors.Wrap(err, "migrate one time token")
+	}
+	if err := db.AutoMigrate(&APIKey{}); err != nil {
+		return nil, errors.Wrap(err, "migrate api key")
+	}
+	if err := db.AutoMigrate(&Invite{}); err != nil {
+		return nil, errors.Wrap(err, "migrate invite")
+	}
+	if err := db.AutoMigrate(&RecoveryCode{}); err != nil {
+		return nil, errors.Wrap(err, "migrate recovery code")
+	}
+	if err := db.AutoMigrate(&DataExport{}); err != nil {
+		return nil, errors.Wrap(err, "migrate data export")
+	}
+	if err := db.AutoMigrate(&UserIdentity{}); err != nil {
+		return nil, errors.Wrap(err, "migrate user identity")
+	}
+	if err := db.AutoMigrate(&OIDCState{}); err != nil {
+		return nil, errors.Wrap(err, "migrate oidc state")
+	}
+	if err := db.AutoMigrate(&LoginThrottle{}); err != nil {
+		return nil, errors.Wrap(err, "migrate login throttle")
+	}
+	if err := db.AutoMigrate(&AuditEvent{}); err != nil {
+		return nil, errors.Wrap(err, "migrate audit event")
+	}
+	if err := dropLegacyTokens(db); err != nil {
+		return nil, errors.Wrap(err, "drop legacy tokens")
+	}
 
 	return db, nil
 }
+
+// dropLegacyTokens removes the opaque bearer tokens that used to be stored on users and sessions.
+// They were replaced with signed access tokens and refresh tokens, so their owners have to log in again.
+func dropLegacyTokens(db *gorm.DB) error {
+	if db.Migrator().HasColumn(&User{}, "token") {
+		if err := db.Migrator().DropColumn(&User{}, "token"); err != nil {
+			return errors.Wrap(err, "drop user token")
+		}
+	}
+	if db.Migrator().HasColumn(&Session{}, "token") {
+		if err := db.Migrator().DropColumn(&Session{}, "token"); err != nil {
+			return errors.Wrap(err, "drop session token")
+		}
+	}
+	return nil
+}
+
+// migrateBookmarkSearch adds the full-text search column of bookmarks, which Postgres keeps up to date,
+// and its index. The column is left out of Bookmark since gorm can't declare generated columns.
+// Words of names weigh the most and those of links the least. Links are split on punctuation
+// and left unstemmed, so that searching for a host or path segment finds them.
+func migrateBookmarkSearch(db *gorm.DB) error {
+	res := db.Exec(`ALTER TABLE bookmarks ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', coalesce(name, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce(description, '')), 'B') ||
+		setweight(to_tsvector('simple', regexp_replace(coalesce(link, ''), '[^[:alnum:]]+', ' ', 'g')), 'C')
+	) STORED`)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "add search column")
+	}
+	res = db.Exec("CREATE INDEX IF NOT EXISTS idx_bookmarks_search ON bookmarks USING GIN (search)")
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "create search index")
+	}
+	return nil
+}
+
+// hashLegacyRefreshTokens replaces refresh tokens stored in clear with their keyed hashes.
+// It runs before the refresh token migration, which could not add the non-null hash column to filled rows.
+func hashLegacyRefreshTokens(db *gorm.DB, cfg *config.Config) error {
+	if !db.Migrator().HasTable(&RefreshToken{}) || !db.Migrator().HasColumn(&RefreshToken{}, "token") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec("ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS token_hash text, ADD COLUMN IF NOT EXISTS token_prefix text")
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "add hash columns")
+		}
+
+		type legacyToken struct {
+			ID    uint64
+			Token string
+		}
+		rows := make([]legacyToken, 0)
+		res = tx.Raw("SELECT id, token FROM refresh_tokens").Scan(&rows)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "read tokens")
+		}
+		for _, row := range rows {
+			res = tx.Exec("UPDATE refresh_tokens SET token_hash = ?, token_prefix = ? WHERE id = ?",
+				token.Hash([]byte(cfg.TokenHashKey), row.Token), token.Prefix(row.Token), row.ID)
+			if res.Error != nil {
+				return errors.Wrap(res.Error, "update token")
+			}
+		}
+
+		res = tx.Exec("ALTER TABLE refresh_tokens ALTER COLUMN token_hash SET NOT NULL, DROP COLUMN token")
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "drop token column")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,130 @@
+package mailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+)
+
+const (
+	KindLog  = "log"
+	KindSMTP = "smtp"
+)
+
+type (
+	Message struct {
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+	}
+
+	Mailer interface {
+		Send(msg Message) error
+	}
+
+	// SMTPMailer delivers messages through an SMTP relay.
+	SMTPMailer struct {
+		addr string
+		auth smtp.Auth
+		from string
+	}
+
+	// LogMailer does not deliver anything: it logs messages and, when a file is configured,
+	// appends them to it as JSON lines, so that local setups and tests can read them back.
+	LogMailer struct {
+		mu     sync.Mutex
+		file   string
+		from   string
+		logger *zap.SugaredLogger
+	}
+)
+
+func NewMailer(cfg *config.Config, logger *zap.SugaredLogger) (Mailer, error) {
+	switch cfg.Mailer {
+	case KindSMTP:
+		return NewSMTPMailer(cfg), nil
+	case KindLog:
+		return NewLogMailer(cfg, logger), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown mailer: %s", cfg.Mailer))
+}
+
+func NewSMTPMailer(cfg *config.Config) *SMTPMailer {
+	m := SMTPMailer{
+		addr: net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+		from: cfg.MailFrom,
+	}
+	if cfg.SMTPUser != "" {
+		m.auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return &m
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, render(m.from, msg)); err != nil {
+		return errors.Wrap(err, "smtp send")
+	}
+	return nil
+}
+
+func NewLogMailer(cfg *config.Config, logger *zap.SugaredLogger) *LogMailer {
+	return &LogMailer{
+		file:   cfg.MailerLogFile,
+		from:   cfg.MailFrom,
+		logger: logger,
+	}
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	m.logger.Infow("mail sent to log", "from", m.from, "to", msg.To, "subject", msg.Subject)
+	if m.file == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(struct {
+		Message
+		SentAt time.Time `json:"sent_at"`
+	}{
+		Message: msg,
+		SentAt:  time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal message")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open mail log")
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "write mail log")
+	}
+	return nil
+}
+
+func render(from string, msg Message) []byte {
+	b := strings.Builder{}
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,11 @@
+package mailer
+
+import (
+	"go.uber.org/fx"
+)
+
+var (
+	Module = fx.Provide(
+		NewMailer,
+	)
+)
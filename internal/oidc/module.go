@@ -0,0 +1,11 @@
+package oidc
+
+import (
+	"go.uber.org/fx"
+)
+
+var (
+	Module = fx.Provide(
+		NewProviders,
+	)
+)
@@ -0,0 +1,336 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+)
+
+var (
+	ErrProviderNotFound = errors.New("oidc provider not found")
+	ErrIDTokenInvalid   = errors.New("id token is invalid")
+)
+
+type (
+	// Providers are the configured OIDC providers by name.
+	Providers map[string]*Provider
+
+	// Provider is a client of one OIDC provider, speaking the authorization code flow with PKCE.
+	// Its endpoints and keys are discovered from the issuer on first use.
+	Provider struct {
+		cfg         config.OIDCProviderConfig
+		redirectURL string
+		client      *http.Client
+
+		mu        sync.Mutex
+		discovery *discovery
+		keys      map[string]*rsa.PublicKey
+	}
+
+	// IDToken holds the verified claims of an ID token this app cares about.
+	IDToken struct {
+		Subject       string
+		Email         string
+		EmailVerified bool
+	}
+
+	discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+
+	jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+
+	idTokenHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	idTokenClaims struct {
+		Iss           string          `json:"iss"`
+		Sub           string          `json:"sub"`
+		Aud           json.RawMessage `json:"aud"`
+		Exp           int64           `json:"exp"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified interface{}     `json:"email_verified"`
+	}
+)
+
+func NewProviders(cfg *config.Config) Providers {
+	providers := Providers{}
+	for _, p := range cfg.OIDCProviders {
+		providers[p.Name] = &Provider{
+			cfg:         p,
+			redirectURL: fmt.Sprintf("%s/auth/oidc/%s/callback", strings.TrimSuffix(cfg.APIURL, "/"), p.Name),
+			client:      &http.Client{Timeout: time.Second * 10},
+		}
+	}
+	return providers
+}
+
+func (p Providers) Get(name string) (*Provider, error) {
+	provider, ok := p[name]
+	if !ok {
+		return nil, ErrProviderNotFound
+	}
+	return provider, nil
+}
+
+// Names returns the names of the configured providers.
+func (p Providers) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	return names
+}
+
+// CodeChallenge derives the S256 PKCE challenge of a code verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns where to send the browser to sign in with the provider.
+func (p *Provider) AuthURL(ctx context.Context, state, nonce, codeVerifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.redirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", CodeChallenge(codeVerifier))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified ID token issued with it.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*IDToken, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "build token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := p.do(req, &resp); err != nil {
+		return nil, errors.Wrap(err, "token request")
+	}
+	if resp.IDToken == "" {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "no id token in response")
+	}
+
+	return p.verify(ctx, d, resp.IDToken, nonce)
+}
+
+func (p *Provider) verify(ctx context.Context, d *discovery, rawToken, nonce string) (*IDToken, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrIDTokenInvalid
+	}
+
+	h := idTokenHeader{}
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	if h.Alg != "RS256" {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "unsupported algorithm "+h.Alg)
+	}
+	key, err := p.getKey(ctx, d, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "bad signature")
+	}
+
+	c := idTokenClaims{}
+	if err := decodeJSON(parts[1], &c); err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	if c.Iss != d.Issuer {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "issuer mismatch")
+	}
+	if !audienceContains(c.Aud, p.cfg.ClientID) {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "audience mismatch")
+	}
+	if time.Now().After(time.Unix(c.Exp, 0)) {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "expired")
+	}
+	if c.Nonce != nonce {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "nonce mismatch")
+	}
+	if c.Sub == "" {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "no subject")
+	}
+
+	return &IDToken{
+		Subject:       c.Sub,
+		Email:         c.Email,
+		EmailVerified: c.EmailVerified == true || c.EmailVerified == "true",
+	}, nil
+}
+
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "build discovery request")
+	}
+	d := discovery{}
+	if err := p.do(req, &d); err != nil {
+		return nil, errors.Wrap(err, "discovery request")
+	}
+	if d.Issuer != p.cfg.Issuer {
+		return nil, errors.New(fmt.Sprintf("discovered issuer %s does not match %s", d.Issuer, p.cfg.Issuer))
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// getKey returns the signing key with the id, refetching the key set once when the id is unknown
+// since providers rotate their keys.
+func (p *Provider) getKey(ctx context.Context, d *discovery, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.JWKSURI, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "build jwks request")
+	}
+	set := jwks{}
+	if err := p.do(req, &set); err != nil {
+		return nil, errors.Wrap(err, "jwks request")
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, errors.Wrap(ErrIDTokenInvalid, "unknown key "+kid)
+	}
+	return key, nil
+}
+
+func (p *Provider) do(req *http.Request, v interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("unexpected status %d", resp.StatusCode))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// audienceContains handles aud being either a string or a list of strings.
+func audienceContains(aud json.RawMessage, clientID string) bool {
+	var single string
+	if err := json.Unmarshal(aud, &single); err == nil {
+		return single == clientID
+	}
+	var list []string
+	if err := json.Unmarshal(aud, &list); err == nil {
+		for _, a := range list {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJSON(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,11 @@
+package passhash
+
+import (
+	"go.uber.org/fx"
+)
+
+var (
+	Module = fx.Provide(
+		NewHasher,
+	)
+)
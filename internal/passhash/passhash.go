@@ -0,0 +1,178 @@
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var (
+	ErrMismatch = errors.New("password does not match")
+	ErrUnknown  = errors.New("unknown password hash format")
+)
+
+type (
+	// Algorithm hashes passwords into self-describing strings, so a stored hash says how to check it.
+	Algorithm interface {
+		Hash(password string) (string, error)
+		// Verify returns ErrMismatch when the password is wrong.
+		Verify(encoded, password string) error
+		// Owns tells whether the hash was made by this algorithm.
+		Owns(encoded string) bool
+		// Outdated tells whether the hash was made with other parameters than the configured ones.
+		Outdated(encoded string) bool
+	}
+
+	// Hasher makes new hashes with the configured algorithm and checks hashes made by any known one.
+	Hasher struct {
+		current    Algorithm
+		algorithms []Algorithm
+	}
+
+	// Argon2id encodes hashes in the PHC string format, e.g. $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>.
+	Argon2id struct {
+		Memory      uint32
+		Iterations  uint32
+		Parallelism uint8
+	}
+
+	// Bcrypt hashes are in the usual $2a$<cost>$... format.
+	Bcrypt struct {
+		Cost int
+	}
+)
+
+func NewHasher(cfg *config.Config) *Hasher {
+	argon := &Argon2id{
+		Memory:      cfg.Argon2Memory,
+		Iterations:  cfg.Argon2Iterations,
+		Parallelism: cfg.Argon2Parallelism,
+	}
+	bc := &Bcrypt{Cost: cfg.BcryptCost}
+
+	h := &Hasher{algorithms: []Algorithm{argon, bc}}
+	switch cfg.PasswordHashAlgorithm {
+	case config.PasswordHashBcrypt:
+		h.current = bc
+	default:
+		h.current = argon
+	}
+	return h
+}
+
+func (h *Hasher) Hash(password string) (string, error) {
+	return h.current.Hash(password)
+}
+
+// Verify checks the password against a hash made by any known algorithm. On success it also tells
+// whether the hash should be replaced with a fresh one, because it uses another algorithm or old parameters.
+func (h *Hasher) Verify(encoded, password string) (rehash bool, err error) {
+	for _, a := range h.algorithms {
+		if !a.Owns(encoded) {
+			continue
+		}
+		if err := a.Verify(encoded, password); err != nil {
+			return false, err
+		}
+		return a != h.current || a.Outdated(encoded), nil
+	}
+	return false, ErrUnknown
+}
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Wrap(err, "read random")
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, argon2KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *Argon2id) Verify(encoded, password string) error {
+	params, salt, key, err := argon2Decode(encoded)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func (a *Argon2id) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a *Argon2id) Outdated(encoded string) bool {
+	params, _, key, err := argon2Decode(encoded)
+	if err != nil {
+		return true
+	}
+	return *params != *a || len(key) != argon2KeyLength
+}
+
+func argon2Decode(encoded string) (*Argon2id, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrUnknown
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errors.Wrap(ErrUnknown, "argon2 version")
+	}
+	params := Argon2id{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return nil, nil, nil, errors.Wrap(ErrUnknown, "argon2 parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(ErrUnknown, "argon2 salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, errors.Wrap(ErrUnknown, "argon2 key")
+	}
+	return &params, salt, key, nil
+}
+
+func (b *Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b *Bcrypt) Verify(encoded, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrMismatch
+	}
+	return err
+}
+
+func (b *Bcrypt) Owns(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b *Bcrypt) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
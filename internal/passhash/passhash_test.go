@@ -0,0 +1,71 @@
+package passhash
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+)
+
+func testConfig(algorithm string) *config.Config {
+	return &config.Config{
+		PasswordHashAlgorithm: algorithm,
+		Argon2Memory:          1024,
+		Argon2Iterations:      1,
+		Argon2Parallelism:     1,
+		BcryptCost:            4,
+	}
+}
+
+func TestArgon2id(t *testing.T) {
+	h := NewHasher(testConfig(config.PasswordHashArgon2id))
+
+	hash, err := h.Hash("correct horse")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	other, err := h.Hash("correct horse")
+	assert.Nil(t, err)
+	assert.NotEqual(t, hash, other, "salt must be random")
+
+	rehash, err := h.Verify(hash, "correct horse")
+	assert.Nil(t, err)
+	assert.False(t, rehash)
+
+	_, err = h.Verify(hash, "wrong horse")
+	assert.Equal(t, ErrMismatch, err)
+}
+
+func TestRehash(t *testing.T) {
+	old := NewHasher(testConfig(config.PasswordHashArgon2id))
+	hash, err := old.Hash("correct horse")
+	assert.Nil(t, err)
+
+	cfg := testConfig(config.PasswordHashArgon2id)
+	cfg.Argon2Iterations = 2
+	rehash, err := NewHasher(cfg).Verify(hash, "correct horse")
+	assert.Nil(t, err)
+	assert.True(t, rehash, "parameters changed")
+
+	legacy, err := NewHasher(testConfig(config.PasswordHashBcrypt)).Hash("correct horse")
+	assert.Nil(t, err)
+	rehash, err = old.Verify(legacy, "correct horse")
+	assert.Nil(t, err)
+	assert.True(t, rehash, "algorithm changed")
+
+	_, err = old.Verify(legacy, "wrong horse")
+	assert.Equal(t, ErrMismatch, err)
+}
+
+func TestUnknown(t *testing.T) {
+	h := NewHasher(testConfig(config.PasswordHashArgon2id))
+
+	_, err := h.Verify("", "")
+	assert.Equal(t, ErrUnknown, err)
+	_, err = h.Verify("plain text", "plain text")
+	assert.Equal(t, ErrUnknown, err)
+	_, err = h.Verify("$argon2id$v=19$m=1024,t=1,p=1$salt", "")
+	assert.Equal(t, ErrUnknown, err)
+}
@@ -0,0 +1,11 @@
+package passpolicy
+
+import (
+	"go.uber.org/fx"
+)
+
+var (
+	Module = fx.Provide(
+		NewPolicy,
+	)
+)
@@ -0,0 +1,203 @@
+package passpolicy
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+)
+
+// Codes of the reasons a password is rejected for.
+const (
+	ReasonTooShort      = "too_short"
+	ReasonTooWeak       = "too_weak"
+	ReasonContainsEmail = "contains_email"
+	ReasonCommon        = "common"
+)
+
+//go:embed common-passwords.txt
+var commonPasswords string
+
+type (
+	Policy struct {
+		minLength  int
+		minEntropy float64
+		blocklist  map[string]struct{}
+	}
+
+	Reason struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	// Error lists every reason the password was rejected for, so they can all be fixed at once.
+	Error struct {
+		Reasons []Reason
+	}
+)
+
+func (e *Error) Error() string {
+	messages := make([]string, len(e.Reasons))
+	for i := range e.Reasons {
+		messages[i] = e.Reasons[i].Message
+	}
+	return "password rejected: " + strings.Join(messages, "; ")
+}
+
+// NewPolicy loads the embedded list of common passwords and the one in PASSWORD_BLOCKLIST_FILE, if set.
+func NewPolicy(cfg *config.Config) (*Policy, error) {
+	p := &Policy{
+		minLength:  cfg.PasswordMinLength,
+		minEntropy: cfg.PasswordMinEntropy,
+		blocklist:  map[string]struct{}{},
+	}
+
+	if err := p.load(strings.NewReader(commonPasswords)); err != nil {
+		return nil, errors.Wrap(err, "load common passwords")
+	}
+	if cfg.PasswordBlocklistFile != "" {
+		f, err := os.Open(cfg.PasswordBlocklistFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "open blocklist")
+		}
+		defer f.Close()
+		if err := p.load(f); err != nil {
+			return nil, errors.Wrap(err, "load blocklist")
+		}
+	}
+	return p, nil
+}
+
+func (p *Policy) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.blocklist[strings.ToLower(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+// Check returns an *Error when the password doesn't meet the policy for the account with the email.
+func (p *Policy) Check(password, email string) error {
+	reasons := make([]Reason, 0)
+
+	if len([]rune(password)) < p.minLength {
+		reasons = append(reasons, Reason{
+			Code:    ReasonTooShort,
+			Message: fmt.Sprintf("must be at least %d characters long", p.minLength),
+		})
+	}
+	if p.common(password) {
+		reasons = append(reasons, Reason{
+			Code:    ReasonCommon,
+			Message: "is too common, it is one of the first ones attackers try",
+		})
+	}
+	if containsEmail(password, email) {
+		reasons = append(reasons, Reason{
+			Code:    ReasonContainsEmail,
+			Message: "must not contain the email address",
+		})
+	}
+	if Entropy(password) < p.minEntropy {
+		reasons = append(reasons, Reason{
+			Code:    ReasonTooWeak,
+			Message: "is too easy to guess, make it longer or mix in other kinds of characters",
+		})
+	}
+
+	if len(reasons) != 0 {
+		return &Error{Reasons: reasons}
+	}
+	return nil
+}
+
+// common also catches listed passwords with digits or symbols tacked on, e.g. "password2021!".
+func (p *Policy) common(password string) bool {
+	password = strings.ToLower(password)
+	if _, ok := p.blocklist[password]; ok {
+		return true
+	}
+	base := strings.TrimRightFunc(password, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	_, ok := p.blocklist[base]
+	return ok && base != ""
+}
+
+func containsEmail(password, email string) bool {
+	password = strings.ToLower(password)
+	email = strings.ToLower(email)
+	if email == "" {
+		return false
+	}
+	if strings.Contains(password, email) {
+		return true
+	}
+	local := email
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		local = email[:i]
+	}
+	// very short local parts would turn up by chance
+	return len(local) >= 4 && strings.Contains(password, local)
+}
+
+// Entropy estimates the strength of the password in bits: its length times the bits per character of
+// the kinds of characters it uses. Characters repeating the previous one or continuing a run like "abc"
+// or "321" are not counted, as guessers try those first.
+func Entropy(password string) float64 {
+	runes := []rune(password)
+
+	var lower, upper, digit, symbol, other bool
+	length := 0
+	for i, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+
+		if i >= 1 && r == runes[i-1] {
+			continue
+		}
+		if i >= 2 {
+			step := r - runes[i-1]
+			if (step == 1 || step == -1) && step == runes[i-1]-runes[i-2] {
+				continue
+			}
+		}
+		length++
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(length) * math.Log2(float64(pool))
+}
@@ -0,0 +1,66 @@
+package passpolicy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+)
+
+func testPolicy(t *testing.T, blocklist string) *Policy {
+	cfg := &config.Config{
+		PasswordMinLength:  12,
+		PasswordMinEntropy: 50,
+	}
+	if blocklist != "" {
+		cfg.PasswordBlocklistFile = filepath.Join(t.TempDir(), "blocklist.txt")
+		assert.Nil(t, ioutil.WriteFile(cfg.PasswordBlocklistFile, []byte(blocklist), 0600))
+	}
+	p, err := NewPolicy(cfg)
+	assert.Nil(t, err)
+	return p
+}
+
+func reasons(err error) []string {
+	if err == nil {
+		return nil
+	}
+	codes := make([]string, 0)
+	for _, r := range err.(*Error).Reasons {
+		codes = append(codes, r.Code)
+	}
+	return codes
+}
+
+func TestCheck(t *testing.T) {
+	p := testPolicy(t, "")
+
+	assert.Nil(t, p.Check("plum-Tractor-Velvet-42", "jane@example.com"))
+	assert.Equal(t, []string{ReasonTooShort, ReasonTooWeak}, reasons(p.Check("aB3$", "jane@example.com")))
+	assert.Equal(t, []string{ReasonCommon, ReasonTooWeak}, reasons(p.Check("111111111111", "jane@example.com")))
+	assert.Equal(t, []string{ReasonCommon}, reasons(p.Check("Password2021!", "jane@example.com")))
+	assert.Equal(t, []string{ReasonContainsEmail}, reasons(p.Check("Jane@Example.com-42", "jane@example.com")))
+	assert.Equal(t, []string{ReasonContainsEmail}, reasons(p.Check("plum-jane-Velvet-42", "jane@example.com")))
+}
+
+func TestBlocklistFile(t *testing.T) {
+	p := testPolicy(t, "# comment\n\nplum-Tractor-Velvet-42\n")
+
+	assert.Equal(t, []string{ReasonCommon}, reasons(p.Check("PLUM-TRACTOR-VELVET-42", "jane@example.com")))
+
+	_, err := NewPolicy(&config.Config{PasswordBlocklistFile: filepath.Join(os.TempDir(), "does-not-exist")})
+	assert.NotNil(t, err)
+}
+
+func TestEntropy(t *testing.T) {
+	assert.Less(t, Entropy("111111111111"), 5.0)
+	assert.Less(t, Entropy("abcdefghijkl"), 10.0)
+	assert.Less(t, Entropy("987654321098"), 15.0)
+	assert.Less(t, Entropy("abcabcabcabc"), 50.0)
+	assert.Greater(t, Entropy("correct horse battery staple"), 100.0)
+	assert.Equal(t, 0.0, Entropy(""))
+}
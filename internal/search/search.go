@@ -0,0 +1,224 @@
+// Package search parses the query language of the bookmark search box, e.g.
+//
+//	golang tag:db -tag:archived site:github.com before:2024-01-01 is:untagged "exact phrase"
+//
+// A query is a list of terms which must all match. Words and quoted phrases search the text, field:value
+// terms filter, and a leading - excludes what the term matches.
+package search
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DateLayout is the layout of the dates of before: and after:.
+const DateLayout = "2006-01-02"
+
+// Fields of the filter terms. Words with a colon but another prefix, like links, are searched as text.
+const (
+	FieldText   Field = ""
+	FieldTag    Field = "tag"
+	FieldSite   Field = "site"
+	FieldBefore Field = "before"
+	FieldAfter  Field = "after"
+	FieldIs     Field = "is"
+)
+
+// IsUntagged is the only value of is: so far.
+const IsUntagged = "untagged"
+
+type (
+	Field string
+
+	Query struct {
+		Terms []Term
+	}
+
+	Term struct {
+		// Pos is where the term starts in the query, in characters from 0, including its -.
+		Pos     int
+		Negated bool
+		Field   Field
+		// Value is the word or phrase of text terms, and the value of filters without quotes.
+		Value string
+		// Phrase tells the value was quoted.
+		Phrase bool
+		// Date is the value of before: and after:, midnight UTC.
+		Date time.Time
+	}
+
+	// SyntaxError tells what is wrong with a query and where, so that clients can point at it.
+	SyntaxError struct {
+		// Pos is in characters from 0.
+		Pos int
+		Msg string
+	}
+)
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// Parse parses the query. An empty or blank query has no terms.
+func Parse(query string) (*Query, error) {
+	p := parser{input: query}
+	q := &Query{Terms: make([]Term, 0)}
+	for {
+		p.skipSpace()
+		if p.done() {
+			return q, nil
+		}
+		t, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		q.Terms = append(q.Terms, t)
+	}
+}
+
+// parser walks the query by bytes and counts characters on the side for the positions it reports.
+type parser struct {
+	input string
+	off   int
+	pos   int
+}
+
+func (p *parser) done() bool {
+	return p.off >= len(p.input)
+}
+
+func (p *parser) peek() rune {
+	r, _ := utf8.DecodeRuneInString(p.input[p.off:])
+	return r
+}
+
+func (p *parser) next() rune {
+	r, size := utf8.DecodeRuneInString(p.input[p.off:])
+	p.off += size
+	p.pos++
+	return r
+}
+
+func (p *parser) skipSpace() {
+	for !p.done() && unicode.IsSpace(p.peek()) {
+		p.next()
+	}
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// term parses [-](word | "phrase" | field:value | field:"value").
+func (p *parser) term() (Term, error) {
+	t := Term{Pos: p.pos}
+	if p.peek() == '-' {
+		p.next()
+		t.Negated = true
+		if p.done() || unicode.IsSpace(p.peek()) {
+			return t, p.errorf(t.Pos, "nothing to exclude after -")
+		}
+	}
+
+	if p.peek() == '"' {
+		value, err := p.phrase()
+		if err != nil {
+			return t, err
+		}
+		t.Value, t.Phrase = value, true
+		return t, nil
+	}
+
+	wordPos := p.pos
+	word := p.word()
+	quoted := !p.done() && p.peek() == '"'
+	field, value := Field(""), word
+	if i := strings.IndexByte(word, ':'); i != -1 {
+		field, value = Field(strings.ToLower(word[:i])), word[i+1:]
+	}
+	switch field {
+	case FieldTag, FieldSite, FieldBefore, FieldAfter, FieldIs:
+	default:
+		// words, and things which aren't filters like links
+		if quoted {
+			return t, p.errorf(p.pos, "unexpected quote")
+		}
+		t.Value = word
+		return t, nil
+	}
+
+	t.Field = field
+	valuePos := wordPos + utf8.RuneCountInString(word) - utf8.RuneCountInString(value)
+	t.Value = value
+	if quoted {
+		if value != "" {
+			return t, p.errorf(p.pos, "unexpected quote")
+		}
+		var err error
+		if t.Value, err = p.phrase(); err != nil {
+			return t, err
+		}
+		t.Phrase = true
+	}
+	return t, p.filterValue(&t, valuePos)
+}
+
+// word reads up to the next space or quote.
+func (p *parser) word() string {
+	start := p.off
+	for !p.done() && !unicode.IsSpace(p.peek()) && p.peek() != '"' {
+		p.next()
+	}
+	return p.input[start:p.off]
+}
+
+// phrase reads a quoted text, which must be followed by a space or the end of the query.
+func (p *parser) phrase() (string, error) {
+	quotePos := p.pos
+	p.next()
+	start := p.off
+	for !p.done() && p.peek() != '"' {
+		p.next()
+	}
+	if p.done() {
+		return "", p.errorf(quotePos, "unterminated quote")
+	}
+	value := p.input[start:p.off]
+	p.next()
+	if !p.done() && !unicode.IsSpace(p.peek()) {
+		return "", p.errorf(p.pos, "expected a space after the closing quote")
+	}
+	if strings.TrimSpace(value) == "" {
+		return "", p.errorf(quotePos, "empty quotes")
+	}
+	return value, nil
+}
+
+// filterValue checks the value of the filter term, which starts at pos.
+func (p *parser) filterValue(t *Term, pos int) error {
+	if t.Value == "" {
+		return p.errorf(pos, "missing value of %s:", t.Field)
+	}
+	switch t.Field {
+	case FieldSite:
+		t.Value = strings.ToLower(strings.Trim(t.Value, "."))
+		if t.Value == "" || strings.ContainsAny(t.Value, "/:?#@ ") {
+			return p.errorf(pos, "site: takes a host name like example.com")
+		}
+	case FieldBefore, FieldAfter:
+		date, err := time.Parse(DateLayout, t.Value)
+		if err != nil {
+			return p.errorf(pos, "%s: takes a date like 2024-01-31", t.Field)
+		}
+		t.Date = date
+	case FieldIs:
+		if strings.ToLower(t.Value) != IsUntagged {
+			return p.errorf(pos, "unknown value of is:, expected %s", IsUntagged)
+		}
+		t.Value = IsUntagged
+	}
+	return nil
+}
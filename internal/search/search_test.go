@@ -0,0 +1,78 @@
+package search
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	q, err := Parse(`golang tag:db -tag:archived site:GitHub.com before:2024-01-01 is:untagged "exact phrase"`)
+	assert.Nil(t, err)
+	assert.Equal(t, []Term{
+		{Pos: 0, Value: "golang"},
+		{Pos: 7, Field: FieldTag, Value: "db"},
+		{Pos: 14, Negated: true, Field: FieldTag, Value: "archived"},
+		{Pos: 28, Field: FieldSite, Value: "github.com"},
+		{Pos: 44, Field: FieldBefore, Value: "2024-01-01", Date: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Pos: 62, Field: FieldIs, Value: IsUntagged},
+		{Pos: 74, Value: "exact phrase", Phrase: true},
+	}, q.Terms)
+}
+
+func TestParseTerms(t *testing.T) {
+	cases := []struct {
+		query string
+		want  []Term
+	}{
+		{"", []Term{}},
+		{"  \t ", []Term{}},
+		{`-"not this"`, []Term{{Negated: true, Value: "not this", Phrase: true}}},
+		{`tag:"read later"`, []Term{{Field: FieldTag, Value: "read later", Phrase: true}}},
+		{"TAG:Go", []Term{{Field: FieldTag, Value: "Go"}}},
+		{"after:2024-02-29", []Term{{
+			Field: FieldAfter, Value: "2024-02-29", Date: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		}}},
+		// unknown fields are text
+		{"https://go.dev", []Term{{Value: "https://go.dev"}}},
+		{"--x", []Term{{Negated: true, Value: "-x"}}},
+		{"ü tag:ß", []Term{{Value: "ü"}, {Pos: 2, Field: FieldTag, Value: "ß"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := Parse(tc.query)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, q.Terms)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		query string
+		pos   int
+	}{
+		{`golang "exact`, 7},
+		{`"phrase"x`, 8},
+		{`""`, 0},
+		{`go -`, 3},
+		{`tag:`, 4},
+		{`go tag: db`, 7},
+		{`ab"c"`, 2},
+		{`tag:db"x"`, 6},
+		{`site:github.com/x`, 5},
+		{`before:yesterday`, 7},
+		{`after:2024-13-01`, 6},
+		{`is:read`, 3},
+		{`ünïcode is:x`, 11},
+	}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			_, err := Parse(tc.query)
+			if assert.IsType(t, &SyntaxError{}, err) {
+				assert.Equal(t, tc.pos, err.(*SyntaxError).Pos, err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/mailer"
+)
+
+var (
+	ErrAccountDeletionNotScheduled = errors.New("account deletion is not scheduled")
+)
+
+// AccountDelete schedules the account to be purged after the grace period, or purges it right away
+// when there is none. The returned time is nil in the latter case.
+func (s *General) AccountDelete(userID uint64, password string) (*time.Time, error) {
+	user := db.User{}
+	res := s.db.First(&user, userID)
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "get user")
+	}
+
+	if err := s.passwordCheck(&user, password); err != nil {
+		return nil, err
+	}
+
+	at := time.Now().Add(s.cfg.AccountDeletionGracePeriod)
+	res = s.db.Model(&user).Update("deletion_scheduled_at", at)
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "schedule deletion")
+	}
+
+	if s.cfg.AccountDeletionGracePeriod == 0 {
+		if err := s.accountPurge(userID); err != nil {
+			return nil, errors.Wrap(err, "purge")
+		}
+		return nil, nil
+	}
+
+	s.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Bookmarker account is going to be deleted",
+		Body: fmt.Sprintf("Your Bookmarker account and all your bookmarks are going to be deleted on %s.\n\n"+
+			"Changed your mind? Sign in and restore the account before then.\n",
+			at.UTC().Format(time.RFC1123)),
+	})
+	return &at, nil
+}
+
+// AccountDeleteCancel restores an account scheduled for deletion.
+func (s *General) AccountDeleteCancel(userID uint64) error {
+	res := s.db.Model(&db.User{}).
+		Where("id = ? AND deletion_scheduled_at IS NOT NULL", userID).
+		Update("deletion_scheduled_at", nil)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "cancel deletion")
+	}
+	if res.RowsAffected == 0 {
+		return ErrAccountDeletionNotScheduled
+	}
+	return nil
+}
+
+// accountsPurge purges every account whose grace period is over.
+func (s *General) accountsPurge() error {
+	ids := make([]uint64, 0)
+	res := s.db.Model(&db.User{}).Where("deletion_scheduled_at <= ?", time.Now()).Pluck("id", &ids)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "find due accounts")
+	}
+
+	for _, id := range ids {
+		if err := s.accountPurge(id); err != nil {
+			return errors.Wrapf(err, "purge user %d", id)
+		}
+		s.logger.Infow("account purged", "user_id", id)
+	}
+	return nil
+}
+
+// accountPurge removes the user with all their data, unless the deletion was cancelled in the meantime.
+func (s *General) accountPurge(userID uint64) error {
+	sessionIDs := make([]uint64, 0)
+	var until time.Time
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		user := db.User{}
+		res := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND deletion_scheduled_at <= ?", userID, time.Now()).
+			First(&user)
+		if res.Error != nil {
+			if res.Error == gorm.ErrRecordNotFound {
+				return nil
+			}
+			return errors.Wrap(res.Error, "lock user")
+		}
+
+		res = tx.Exec("DELETE FROM tag_bookmarks WHERE bookmark_id IN (SELECT id FROM bookmarks WHERE user_id = ?) "+
+			"OR tag_id IN (SELECT id FROM tags WHERE user_id = ?)", userID, userID)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete tag bookmarks")
+		}
+		res = tx.Where("user_id = ?", userID).Delete(&db.Bookmark{})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete bookmarks")
+		}
+		res = tx.Where("user_id = ?", userID).Delete(&db.Tag{})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete tags")
+		}
+
+		res = tx.Model(&db.Session{}).Where("user_id = ?", userID).Pluck("id", &sessionIDs)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "find sessions")
+		}
+		res = tx.Where("user_id = ?", userID).Delete(&db.Session{})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete sessions")
+		}
+		var err error
+		if until, err = s.sessionsRevoke(tx, sessionIDs); err != nil {
+			return err
+		}
+
+		if err := auditEventsAnonymise(tx, &user); err != nil {
+			return err
+		}
+		// throttles keyed by the email
+		keys := []string{
+			loginThrottleAccountKey(user.Email), magicLinkThrottleKey(user.Email), passwordResetThrottleKey(user.Email),
+		}
+		res = tx.Where("key IN ?", keys).Delete(&db.LoginThrottle{})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete throttles")
+		}
+
+		// Tokens, API keys, recovery codes and identities go with the user.
+		res = tx.Delete(&user)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete user")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range sessionIDs {
+		s.revokedSessions.Add(id, until)
+	}
+	return nil
+}
+
+// auditEventsAnonymise keeps the events of the user for statistics but removes what tells who and where
+// they were: the account, addresses, user agents and details, which may mention the email.
+func auditEventsAnonymise(tx *gorm.DB, user *db.User) error {
+	res := tx.Model(&db.AuditEvent{}).Where("user_id = ?", user.ID).Updates(map[string]interface{}{
+		"user_id":    nil,
+		"ip":         "",
+		"user_agent": "",
+		"details":    "",
+	})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "anonymise audit events")
+	}
+	// actions of the user on other accounts, as an admin
+	res = tx.Model(&db.AuditEvent{}).Where("actor_id = ?", user.ID).Updates(map[string]interface{}{
+		"actor_id":   nil,
+		"ip":         "",
+		"user_agent": "",
+	})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "anonymise audit events as actor")
+	}
+	// failures of unknown accounts, like logins before registering, only have the email,
+	// which may be any the user had or asked to change to, written in any case
+	emails := make([]string, 0)
+	res = tx.Model(&db.OneTimeToken{}).Where("user_id = ? AND kind = ?", user.ID, oneTimeTokenEmailChange).
+		Distinct().Pluck("payload", &emails)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "find earlier emails")
+	}
+	emails = append(emails, user.Email)
+	for _, email := range emails {
+		details := "email " + strings.ToLower(email)
+		res = tx.Model(&db.AuditEvent{}).
+			Where("user_id IS NULL AND (lower(details) = ? OR starts_with(lower(details), ?))", details, details+": ").
+			Updates(map[string]interface{}{"ip": "", "user_agent": "", "details": ""})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "anonymise audit events by email")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrUserDisabled    = errors.New("account is disabled")
+	ErrNotAdmin        = errors.New("admin role required")
+	ErrAdminSelfAction = errors.New("admins cannot do this to their own account")
+)
+
+type (
+	// UserSummary is a user as admins see it.
+	UserSummary struct {
+		ID              uint64
+		Email           string
+		Role            string
+		EmailVerifiedAt *time.Time
+		TOTPEnabledAt   *time.Time
+		DisabledAt      *time.Time
+		CreatedAt       time.Time
+		BookmarkCount   int64
+		TagCount        int64
+	}
+
+	// userSet is a set of user IDs safe for concurrent use.
+	userSet struct {
+		mu  sync.RWMutex
+		ids map[uint64]struct{}
+	}
+)
+
+func newUserSet() *userSet {
+	return &userSet{ids: map[uint64]struct{}{}}
+}
+
+func (u *userSet) Add(id uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ids[id] = struct{}{}
+}
+
+func (u *userSet) Remove(id uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.ids, id)
+}
+
+func (u *userSet) Has(id uint64) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	_, ok := u.ids[id]
+	return ok
+}
+
+func (u *userSet) Replace(ids []uint64) {
+	set := make(map[uint64]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ids = set
+}
+
+// AdminCheck returns ErrNotAdmin unless the user has the admin role. The role is read from the database
+// every time, so revoking it takes effect right away.
+func (s *General) AdminCheck(userID uint64) error {
+	user := db.User{}
+	res := s.db.Select("id", "role").First(&user, userID)
+	if res.Error != nil {
+		if res.Error == gorm.ErrRecordNotFound {
+			return ErrNotAdmin
+		}
+		return errors.Wrap(res.Error, "get user")
+	}
+	if user.Role != RoleAdmin {
+		return ErrNotAdmin
+	}
+	return nil
+}
+
+// AdminUserList pages through users whose email contains the query, along with how much they store,
+// and returns the total count of matching users.
+func (s *General) AdminUserList(query string, limit, offset uint64) ([]UserSummary, int64, error) {
+	w := squirrel.And{}
+	if query != "" {
+		w = append(w, squirrel.Expr("u.email ILIKE ?", "%"+escapeLike(query)+"%"))
+	}
+
+	sql, args, err := squirrel.Select("count(*)").From("users u").Where(w).ToSql()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "build count sql")
+	}
+	var total int64
+	res := s.db.Raw(sql, args...).Scan(&total)
+	if res.Error != nil {
+		return nil, 0, errors.Wrap(res.Error, "count")
+	}
+
+	sql, args, err = userSummarySelect().
+		Where(w).
+		OrderBy("u.id").
+		Limit(limit).
+		Offset(offset).
+		ToSql()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "build sql")
+	}
+	users := make([]UserSummary, 0)
+	res = s.db.Raw(sql, args...).Scan(&users)
+	if res.Error != nil {
+		return nil, 0, errors.Wrap(res.Error, "scan")
+	}
+
+	return users, total, nil
+}
+
+func (s *General) AdminUserGet(userID uint64) (*UserSummary, error) {
+	sql, args, err := userSummarySelect().Where(squirrel.Eq{"u.id": userID}).ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "build sql")
+	}
+	users := make([]UserSummary, 0)
+	res := s.db.Raw(sql, args...).Scan(&users)
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "scan")
+	}
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return &users[0], nil
+}
+
+// AdminUserDisable locks the user out: every session is revoked and neither logins nor API keys work
+// until the user is enabled again.
+func (s *General) AdminUserDisable(adminID, userID uint64) error {
+	if adminID == userID {
+		return ErrAdminSelfAction
+	}
+
+	res := s.db.Model(&db.User{}).Where("id = ?", userID).
+		Update("disabled_at", gorm.Expr("COALESCE(disabled_at, ?)", time.Now()))
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "disable")
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	s.disabledUsers.Add(userID)
+
+	if err := s.sessionsDelete(s.db.Where("user_id = ?", userID)); err != nil {
+		return errors.Wrap(err, "revoke sessions")
+	}
+	return nil
+}
+
+func (s *General) AdminUserEnable(userID uint64) error {
+	res := s.db.Model(&db.User{}).Where("id = ?", userID).Update("disabled_at", nil)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "enable")
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	s.disabledUsers.Remove(userID)
+	return nil
+}
+
+// AdminUserLogout revokes every session of the user. API keys are left alone.
+func (s *General) AdminUserLogout(userID uint64) error {
+	if err := s.userExists(userID); err != nil {
+		return err
+	}
+	return s.sessionsDelete(s.db.Where("user_id = ?", userID))
+}
+
+// AdminUserPasswordReset emails the user a password reset link, as if they asked for it.
+func (s *General) AdminUserPasswordReset(userID uint64) error {
+	user := db.User{}
+	res := s.db.First(&user, userID)
+	if res.Error != nil {
+		if res.Error == gorm.ErrRecordNotFound {
+			return ErrUserNotFound
+		}
+		return errors.Wrap(res.Error, "get user")
+	}
+	return s.PasswordResetRequest(user.Email)
+}
+
+func (s *General) userExists(userID uint64) error {
+	var count int64
+	res := s.db.Model(&db.User{}).Where("id = ?", userID).Count(&count)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "count users")
+	}
+	if count == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// userAccessSync reloads the disabled users and revoked sessions and promotes the verified accounts
+// listed in ADMIN_EMAILS.
+func (s *General) userAccessSync() error {
+	if admins := s.cfg.Admins(); len(admins) != 0 {
+		res := s.db.Model(&db.User{}).
+			Where("lower(email) IN ? AND email_verified_at IS NOT NULL AND role <> ?", admins, RoleAdmin).
+			Update("role", RoleAdmin)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "promote admins")
+		}
+		if res.RowsAffected != 0 {
+			s.logger.Infow("promoted users listed in ADMIN_EMAILS", "count", res.RowsAffected)
+		}
+	}
+
+	ids := make([]uint64, 0)
+	res := s.db.Model(&db.User{}).Where("disabled_at IS NOT NULL").Pluck("id", &ids)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "find disabled users")
+	}
+	s.disabledUsers.Replace(ids)
+
+	return s.revokedSessionsSync()
+}
+
+func userSummarySelect() squirrel.SelectBuilder {
+	return squirrel.Select("u.id", "u.email", "u.role", "u.email_verified_at", "u.totp_enabled_at",
+		"u.disabled_at", "u.created_at",
+		"(SELECT count(*) FROM bookmarks b WHERE b.user_id = u.id) AS bookmark_count",
+		"(SELECT count(*) FROM tags t WHERE t.user_id = u.id) AS tag_count").
+		From("users u")
+}
+
+// escapeLike makes LIKE wildcards in user input match literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
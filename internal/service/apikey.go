@@ -0,0 +1,128 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/token"
+)
+
+const (
+	ScopeBookmarksRead  = "bookmarks:read"
+	ScopeBookmarksWrite = "bookmarks:write"
+	ScopeTagsRead       = "tags:read"
+	ScopeTagsWrite      = "tags:write"
+
+	// apiKeyPrefix tells API keys apart from access tokens.
+	apiKeyPrefix = "bmk_"
+	// apiKeyTouchInterval limits how often last_used_at is written for a busy key.
+	apiKeyTouchInterval = time.Minute
+)
+
+var (
+	Scopes = []string{ScopeBookmarksRead, ScopeBookmarksWrite, ScopeTagsRead, ScopeTagsWrite}
+
+	ErrAPIKeyNotFound     = errors.New("api key not found")
+	ErrAPIKeyInvalid      = errors.New("api key is invalid")
+	ErrAPIKeyScopeUnknown = errors.New("unknown scope")
+)
+
+// IsAPIKey tells whether a credential is an API key rather than an access token.
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, apiKeyPrefix)
+}
+
+// APIKeyCreate creates a key with the scopes and returns it along with the key in clear,
+// which is not stored and can't be shown again.
+func (s *General) APIKeyCreate(userID uint64, name string, scopes []string) (*db.APIKey, string, error) {
+	for _, scope := range scopes {
+		if !scopeKnown(scope) {
+			return nil, "", errors.Wrap(ErrAPIKeyScopeUnknown, scope)
+		}
+	}
+
+	t, err := randomToken()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "generate key")
+	}
+	t = apiKeyPrefix + t
+
+	model := db.APIKey{
+		Name:        name,
+		TokenHash:   s.hashToken(t),
+		TokenPrefix: token.Prefix(t),
+		Scopes:      strings.Join(scopes, " "),
+		UserID:      userID,
+	}
+	res := s.db.Create(&model)
+	if res.Error != nil {
+		return nil, "", res.Error
+	}
+
+	return &model, t, nil
+}
+
+func (s *General) APIKeyList(userID uint64) ([]db.APIKey, error) {
+	keys := make([]db.APIKey, 0)
+
+	res := s.db.Where("user_id = ?", userID).Order("id").Find(&keys)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	return keys, nil
+}
+
+func (s *General) APIKeyDelete(userID, id uint64) error {
+	res := s.db.Where("user_id = ?", userID).Delete(&db.APIKey{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// APIKeyAuthenticate resolves an API key and records that it was used.
+func (s *General) APIKeyAuthenticate(key string) (*db.APIKey, error) {
+	model := db.APIKey{}
+	res := s.db.Where("token_hash = ?", s.hashToken(key)).First(&model)
+	if res.Error != nil {
+		if res.Error == gorm.ErrRecordNotFound {
+			return nil, ErrAPIKeyInvalid
+		}
+		return nil, errors.Wrap(res.Error, "get key")
+	}
+	if s.disabledUsers.Has(model.UserID) {
+		return nil, ErrUserDisabled
+	}
+
+	now := time.Now()
+	if model.LastUsedAt == nil || now.Sub(*model.LastUsedAt) > apiKeyTouchInterval {
+		res = s.db.Model(&model).UpdateColumn("last_used_at", now)
+		if res.Error != nil {
+			return nil, errors.Wrap(res.Error, "touch key")
+		}
+	}
+
+	return &model, nil
+}
+
+// APIKeyScopes splits the stored scopes of a key.
+func APIKeyScopes(key *db.APIKey) []string {
+	return strings.Fields(key.Scopes)
+}
+
+func scopeKnown(scope string) bool {
+	for _, known := range Scopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+)
+
+// Audit events.
+const (
+	AuditRegister               = "register"
+	AuditLogin                  = "login"
+	AuditLoginTwoFactor         = "login.two_factor"
+	AuditLoginOIDC              = "login.oidc"
+	AuditLoginMagicLink         = "login.magic_link"
+	AuditRefreshReuse           = "session.refresh_reuse"
+	AuditLogout                 = "session.logout"
+	AuditSessionRevoke          = "session.revoke"
+	AuditSessionRevokeOthers    = "session.revoke_others"
+	AuditPasswordChange         = "password.change"
+	AuditPasswordReset          = "password.reset"
+	AuditEmailChangeRequest     = "email.change_request"
+	AuditEmailChange            = "email.change"
+	AuditTwoFactorEnable        = "two_factor.enable"
+	AuditTwoFactorDisable       = "two_factor.disable"
+	AuditAPIKeyCreate           = "api_key.create"
+	AuditAPIKeyDelete           = "api_key.delete"
+	AuditInviteCreate           = "invite.create"
+	AuditInviteDelete           = "invite.delete"
+	AuditAccountDelete          = "account.delete"
+	AuditAccountDeleteCancel    = "account.delete_cancel"
+	AuditAdminUserDisable       = "admin.user_disable"
+	AuditAdminUserEnable        = "admin.user_enable"
+	AuditAdminUserLogout        = "admin.user_logout"
+	AuditAdminUserPasswordReset = "admin.user_password_reset"
+
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+
+	auditMaxLimit = 100
+)
+
+type (
+	AuditEntry struct {
+		Event string
+		// UserID is whose account the event is about, zero if unknown, e.g. for a login with a wrong email.
+		UserID uint64
+		// ActorID is who caused the event, zero when it is the user themselves.
+		ActorID uint64
+		Client  ClientInfo
+		// Err is the outcome, nil meaning success. Its message ends up in the details.
+		Err     error
+		Details string
+	}
+
+	AuditFilter struct {
+		UserID  uint64
+		ActorID uint64
+		Event   string
+		Outcome string
+		IP      string
+		From    *time.Time
+		To      *time.Time
+		// Before continues a listing from the last event of the previous page.
+		Before uint64
+		Limit  uint64
+	}
+)
+
+// Audit appends the entry to the audit log. Failing to do so is logged rather than failing whatever
+// was being done.
+func (s *General) Audit(e AuditEntry) {
+	event := db.AuditEvent{
+		Event:     e.Event,
+		Outcome:   AuditSuccess,
+		IP:        e.Client.IP,
+		UserAgent: e.Client.UserAgent,
+		Details:   e.Details,
+	}
+	if e.UserID != 0 {
+		event.UserID = &e.UserID
+	}
+	event.ActorID = event.UserID
+	if e.ActorID != 0 {
+		event.ActorID = &e.ActorID
+	}
+	if e.Err != nil {
+		event.Outcome = AuditFailure
+		reason := errors.Cause(e.Err).Error()
+		if event.Details != "" {
+			reason = event.Details + ": " + reason
+		}
+		event.Details = reason
+	}
+
+	if res := s.db.Create(&event); res.Error != nil {
+		s.logger.Errorw("write audit event", "event", e.Event, "user_id", e.UserID, "error", res.Error)
+	}
+}
+
+// AuditList returns the newest events matching the filter first.
+func (s *General) AuditList(f AuditFilter) ([]db.AuditEvent, error) {
+	w := squirrel.And{}
+	if f.UserID != 0 {
+		w = append(w, squirrel.Eq{"user_id": f.UserID})
+	}
+	if f.ActorID != 0 {
+		w = append(w, squirrel.Eq{"actor_id": f.ActorID})
+	}
+	if f.Event != "" {
+		w = append(w, squirrel.Eq{"event": f.Event})
+	}
+	if f.Outcome != "" {
+		w = append(w, squirrel.Eq{"outcome": f.Outcome})
+	}
+	if f.IP != "" {
+		w = append(w, squirrel.Eq{"ip": f.IP})
+	}
+	if f.From != nil {
+		w = append(w, squirrel.GtOrEq{"created_at": *f.From})
+	}
+	if f.To != nil {
+		w = append(w, squirrel.Lt{"created_at": *f.To})
+	}
+	if f.Before != 0 {
+		w = append(w, squirrel.Lt{"id": f.Before})
+	}
+	if f.Limit == 0 || f.Limit > auditMaxLimit {
+		f.Limit = auditMaxLimit
+	}
+
+	sql, args, err := squirrel.Select("*").From("audit_events").
+		Where(w).
+		OrderBy("id DESC").
+		Limit(f.Limit).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "build sql")
+	}
+
+	events := make([]db.AuditEvent, 0)
+	res := s.db.Raw(sql, args...).Scan(&events)
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "scan")
+	}
+	return events, nil
+}
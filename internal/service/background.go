@@ -0,0 +1,42 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+// every runs the job right after start and then at the interval while the app is running.
+// Errors are logged, the job is retried on the next tick.
+func (s *General) every(lc fx.Lifecycle, name string, interval time.Duration, job func() error) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			go func() {
+				run := func() {
+					if err := job(); err != nil {
+						s.logger.Errorw("background job failed", "job", name, "error", err)
+					}
+				}
+				run()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+						run()
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			ticker.Stop()
+			close(done)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/pkg/errors"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/search"
+)
+
+const (
+	bookmarkMaxLimit = 100
+	// bookmarkRank ranks the bookmarks b against the search, given as its argument.
+	bookmarkRank = "ts_rank(b.search, websearch_to_tsquery('english', ?))"
+)
+
+// Postgres marks the matches of highlights with these private use characters, which can't be confused
+// with the text, and they become <mark> tags once the text is escaped.
+const (
+	highlightStart = "\ue000"
+	highlightStop  = "\ue001"
+)
+
+var (
+	ErrBookmarkCursorInvalid = errors.New("cursor is invalid")
+)
+
+type (
+	// BookmarkFilter selects a page of bookmarks for BookmarkGet.
+	BookmarkFilter struct {
+		// TagsAll keeps bookmarks having every one of the tags, TagsAny those having at least one of them
+		// and TagsNone those having none. Untagged keeps bookmarks without any tag.
+		TagsAll  []uint64
+		TagsAny  []uint64
+		TagsNone []uint64
+		Untagged bool
+		// Query is in the language of the search package. When it has words or phrases,
+		// matching bookmarks come best first.
+		Query string
+		// Limit is the page size, bookmarkMaxLimit at most.
+		Limit uint64
+		// Cursor is the next cursor returned with the previous page, empty for the first page.
+		Cursor string
+	}
+
+	// bookmarkCursor is the position after the last bookmark of a page. Clients get it encoded
+	// and should not rely on what's inside, so that it can change along with the ordering.
+	bookmarkCursor struct {
+		ID uint64 `json:"id"`
+		// Rank is set when searching, results being ordered by it first.
+		Rank *float32 `json:"rank,omitempty"`
+	}
+
+	// BookmarkListItem is a bookmark of a page returned by BookmarkGet.
+	BookmarkListItem struct {
+		db.Bookmark
+		// Searched tells the query had text to search, which the rank and highlights are about.
+		Searched bool `gorm:"-"`
+		// Rank tells how well the bookmark matches the text.
+		Rank float32
+		// NameHighlight and DescriptionHighlight are HTML escaped, with the matches between <mark> tags.
+		// The description one only keeps the fragments around the matches.
+		NameHighlight        string
+		DescriptionHighlight string
+	}
+)
+
+func encodeBookmarkCursor(c bookmarkCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeBookmarkCursor returns nil for an empty cursor, meaning the first page.
+func decodeBookmarkCursor(s string) (*bookmarkCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrBookmarkCursorInvalid
+	}
+	c := bookmarkCursor{}
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == 0 {
+		return nil, ErrBookmarkCursorInvalid
+	}
+	return &c, nil
+}
+
+// tagConditions are the conditions on the bookmarks b for the tag sets of the filter. Subqueries rather
+// than a join with tag_bookmarks return each bookmark once, however many of its tags match.
+func (f *BookmarkFilter) tagConditions() squirrel.And {
+	w := squirrel.And{}
+	for _, id := range uniqueIDs(f.TagsAll) {
+		w = append(w, squirrel.Expr("EXISTS (?)", bookmarkTagsSelect([]uint64{id})))
+	}
+	if len(f.TagsAny) != 0 {
+		w = append(w, squirrel.Expr("EXISTS (?)", bookmarkTagsSelect(f.TagsAny)))
+	}
+	if len(f.TagsNone) != 0 {
+		w = append(w, squirrel.Expr("NOT EXISTS (?)", bookmarkTagsSelect(f.TagsNone)))
+	}
+	if f.Untagged {
+		w = append(w, squirrel.Expr("NOT EXISTS (?)", bookmarkTagsSelect(nil)))
+	}
+	return w
+}
+
+// searchConditions compiles the filters of the query to conditions on the bookmarks b, and its words
+// and phrases to the web search syntax of websearch_to_tsquery, which is empty if there are none.
+func searchConditions(q *search.Query) (squirrel.And, string) {
+	w := squirrel.And{}
+	text := make([]string, 0)
+	for _, t := range q.Terms {
+		var c squirrel.Sqlizer
+		switch t.Field {
+		case search.FieldText:
+			word := t.Value
+			if t.Phrase {
+				word = `"` + word + `"`
+			}
+			if t.Negated {
+				word = "-" + word
+			}
+			text = append(text, word)
+			continue
+		case search.FieldTag:
+			c = squirrel.Expr("EXISTS (?)", squirrel.Select("1").From("tag_bookmarks tb").
+				Join("tags t ON t.id = tb.tag_id").
+				Where("tb.bookmark_id = b.id AND lower(t.name) = lower(?)", t.Value))
+		case search.FieldSite:
+			// the host or one of its subdomains, after the scheme and user info if any
+			c = squirrel.Expr("coalesce(b.link, '') ~* ?",
+				`^([a-z][a-z0-9+.-]*://)?([^/?#@]*@)?([^/?#@]*\.)?`+regexp.QuoteMeta(t.Value)+`(:[0-9]*)?([/?#]|$)`)
+		case search.FieldBefore:
+			c = squirrel.Lt{"b.created_at": t.Date}
+		case search.FieldAfter:
+			c = squirrel.GtOrEq{"b.created_at": t.Date}
+		case search.FieldIs:
+			c = squirrel.Expr("NOT EXISTS (?)", bookmarkTagsSelect(nil))
+		}
+		if t.Negated {
+			c = squirrel.Expr("NOT (?)", c)
+		}
+		w = append(w, c)
+	}
+	return w, strings.Join(text, " ")
+}
+
+// bookmarkTagsSelect selects the links of the bookmark b to the tags, or to any tag if there are none.
+func bookmarkTagsSelect(tagIDs []uint64) squirrel.SelectBuilder {
+	q := squirrel.Select("1").From("tag_bookmarks tb").Where("tb.bookmark_id = b.id")
+	if len(tagIDs) != 0 {
+		q = q.Where(squirrel.Eq{"tb.tag_id": tagIDs})
+	}
+	return q
+}
+
+func uniqueIDs(ids []uint64) []uint64 {
+	seen := make(map[uint64]struct{}, len(ids))
+	unique := make([]uint64, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// bookmarkHighlights wraps the page of search results p in a select adding the highlights, so that
+// they are only computed for the bookmarks returned.
+func bookmarkHighlights(p squirrel.SelectBuilder, query string) squirrel.SelectBuilder {
+	headline := func(column, options string) squirrel.Sqlizer {
+		return squirrel.Expr("ts_headline('english', coalesce("+column+", ''), websearch_to_tsquery('english', ?), ?)",
+			query, `StartSel="`+highlightStart+`", StopSel="`+highlightStop+`", `+options)
+	}
+	return squirrel.Select("p.*").
+		Column(squirrel.Alias(headline("p.name", "HighlightAll=true"), "name_highlight")).
+		Column(squirrel.Alias(headline("p.description", "MaxFragments=2, MaxWords=20, MinWords=8"), "description_highlight")).
+		FromSelect(p, "p").
+		OrderBy("p.rank DESC", "p.id")
+}
+
+func highlightHTML(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, highlightStart, "<mark>")
+	return strings.ReplaceAll(s, highlightStop, "</mark>")
+}
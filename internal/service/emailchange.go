@@ -0,0 +1,124 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/mailer"
+)
+
+// pgUniqueViolation is the Postgres error code of a unique constraint violation.
+const pgUniqueViolation = "23505"
+
+var (
+	ErrEmailUnchanged = errors.New("new email is the current one")
+	ErrEmailTaken     = errors.New("email is used by another account")
+)
+
+// EmailChangeRequest sends a confirmation link to the new address and a notice to the current one.
+// The address only changes once the link is opened, and only the latest link works.
+func (s *General) EmailChangeRequest(userID uint64, password, newEmail string) error {
+	user := db.User{}
+	res := s.db.First(&user, userID)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "get user")
+	}
+	if err := s.passwordCheck(&user, password); err != nil {
+		return err
+	}
+	if newEmail == user.Email {
+		return ErrEmailUnchanged
+	}
+	if err := s.emailAvailable(newEmail); err != nil {
+		return err
+	}
+
+	var t string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.oneTimeTokensRevoke(tx, userID, oneTimeTokenEmailChange); err != nil {
+			return errors.Wrap(err, "revoke earlier requests")
+		}
+
+		var err error
+		t, err = s.oneTimeTokenCreateWithPayload(tx, userID, oneTimeTokenEmailChange, newEmail, s.cfg.EmailVerificationTTL)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "create email change token")
+	}
+
+	s.sendMail(mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new Bookmarker email",
+		Body: fmt.Sprintf("Someone asked to use this address for their Bookmarker account.\n\n"+
+			"To confirm open the link below, it is valid for %s:\n%s\n\n"+
+			"If it wasn't you, just ignore this email.\n",
+			s.cfg.EmailVerificationTTL, s.link("/confirm-email", t)),
+	})
+	s.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Bookmarker email is about to change",
+		Body: fmt.Sprintf("Someone asked to change the address of your Bookmarker account to %s.\n\n"+
+			"Nothing changes until the link sent there is opened. If it wasn't you, "+
+			"change your password right away, whoever asked knows it.\n", newEmail),
+	})
+	return nil
+}
+
+// EmailChangeConfirm switches the user to the address the token was sent to, which is verified by that.
+// Other emailed links of the user are revoked.
+func (s *General) EmailChangeConfirm(t string, client ClientInfo) (err error) {
+	var userID uint64
+	defer func() {
+		if userID != 0 {
+			s.Audit(AuditEntry{Event: AuditEmailChange, UserID: userID, Client: client, Err: err})
+		}
+	}()
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		model, err := s.oneTimeTokenConsume(tx, t, oneTimeTokenEmailChange)
+		if err != nil {
+			return err
+		}
+		userID = model.UserID
+
+		res := tx.Model(&db.User{}).Where("id = ?", model.UserID).Updates(map[string]interface{}{
+			"email":             model.Payload,
+			"email_verified_at": time.Now(),
+		})
+		if res.Error != nil {
+			// someone took the address since the change was asked for
+			if isUniqueViolation(res.Error) {
+				return ErrEmailTaken
+			}
+			return errors.Wrap(res.Error, "update email")
+		}
+		// links mailed to the old address, which may be out of the user's hands, stop working
+		if err := s.oneTimeTokensRevoke(tx, model.UserID); err != nil {
+			return errors.Wrap(err, "revoke tokens of the old email")
+		}
+		return nil
+	})
+}
+
+func (s *General) emailAvailable(email string) error {
+	var count int64
+	res := s.db.Model(&db.User{}).Where("email = ?", email).Count(&count)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "count users")
+	}
+	if count != 0 {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
+}
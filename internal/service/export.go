@@ -0,0 +1,299 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/mailer"
+)
+
+const (
+	DataExportPending = "pending"
+	DataExportRunning = "running"
+	DataExportDone    = "done"
+	DataExportFailed  = "failed"
+
+	// dataExportStaleAfter is when a running export is assumed to be lost with a restart and is queued again.
+	dataExportStaleAfter = time.Hour
+)
+
+var (
+	ErrDataExportNotFound    = errors.New("data export not found")
+	ErrDataExportLinkInvalid = errors.New("download link is invalid or expired")
+)
+
+type (
+	exportProfile struct {
+		ID               uint64     `json:"id"`
+		Email            string     `json:"email"`
+		EmailVerifiedAt  *time.Time `json:"email_verified_at"`
+		TwoFactorEnabled bool       `json:"two_factor_enabled"`
+		CreatedAt        time.Time  `json:"created_at"`
+	}
+
+	exportTag struct {
+		ID        uint64    `json:"id"`
+		Name      string    `json:"name"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	exportBookmark struct {
+		ID          uint64      `json:"id"`
+		Name        *string     `json:"name"`
+		Link        *string     `json:"link"`
+		Description *string     `json:"description"`
+		Tags        []exportTag `json:"tags"`
+		CreatedAt   time.Time   `json:"created_at"`
+		UpdatedAt   time.Time   `json:"updated_at"`
+	}
+)
+
+// DataExportCreate queues an export of everything stored about the user, unless one is already on its way
+// or done and not expired yet, which keeps users from building archive after archive.
+func (s *General) DataExportCreate(userID uint64) (*db.DataExport, error) {
+	export := db.DataExport{}
+	res := s.db.Omit("archive").
+		Where("user_id = ? AND (status IN ? OR status = ? AND expires_at > ?)", userID,
+			[]string{DataExportPending, DataExportRunning}, DataExportDone, time.Now()).
+		Order("id DESC").
+		First(&export)
+	if res.Error == nil {
+		return &export, nil
+	}
+	if res.Error != gorm.ErrRecordNotFound {
+		return nil, errors.Wrap(res.Error, "find current export")
+	}
+
+	export = db.DataExport{
+		Status: DataExportPending,
+		UserID: userID,
+	}
+	res = s.db.Create(&export)
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "create export")
+	}
+
+	go func() {
+		if err := s.dataExportRun(export.ID); err != nil {
+			s.logger.Errorw("data export failed", "export_id", export.ID, "error", err)
+		}
+	}()
+	return &export, nil
+}
+
+// DataExportGet returns the export without the archive itself.
+func (s *General) DataExportGet(userID, id uint64) (*db.DataExport, error) {
+	export := db.DataExport{}
+	res := s.db.Omit("archive").Where("id = ? AND user_id = ?", id, userID).First(&export)
+	if res.Error != nil {
+		if res.Error == gorm.ErrRecordNotFound {
+			return nil, ErrDataExportNotFound
+		}
+		return nil, errors.Wrap(res.Error, "get export")
+	}
+	return &export, nil
+}
+
+// DataExportLink returns a signed link to download a finished export, usable without logging in
+// until it expires.
+func (s *General) DataExportLink(export *db.DataExport) (string, time.Time) {
+	expiresAt := time.Now().Add(s.cfg.DataExportLinkTTL)
+	if export.ExpiresAt != nil && export.ExpiresAt.Before(expiresAt) {
+		expiresAt = *export.ExpiresAt
+	}
+	return fmt.Sprintf("%s/auth/export/download?id=%d&expires=%d&signature=%s", s.cfg.APIURL, export.ID,
+		expiresAt.Unix(), s.dataExportSignature(export.ID, expiresAt.Unix())), expiresAt
+}
+
+// DataExportDownload checks a link made by DataExportLink and returns the archive it points to.
+func (s *General) DataExportDownload(id uint64, expires int64, signature string) ([]byte, error) {
+	expected := s.dataExportSignature(id, expires)
+	if time.Now().Unix() > expires || !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, ErrDataExportLinkInvalid
+	}
+
+	export := db.DataExport{}
+	res := s.db.Where("id = ? AND status = ? AND expires_at > ?", id, DataExportDone, time.Now()).First(&export)
+	if res.Error != nil {
+		if res.Error == gorm.ErrRecordNotFound {
+			return nil, ErrDataExportLinkInvalid
+		}
+		return nil, errors.Wrap(res.Error, "get export")
+	}
+	return export.Archive, nil
+}
+
+func (s *General) dataExportSignature(id uint64, expires int64) string {
+	return s.hashToken(fmt.Sprintf("data-export:%d:%d", id, expires))
+}
+
+// dataExportsProcess runs the exports nobody picked up, e.g. because of a restart, and drops expired ones.
+func (s *General) dataExportsProcess() error {
+	res := s.db.Where("expires_at < ?", time.Now()).Delete(&db.DataExport{})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "delete expired")
+	}
+
+	res = s.db.Model(&db.DataExport{}).
+		Where("status = ? AND updated_at < ?", DataExportRunning, time.Now().Add(-dataExportStaleAfter)).
+		Update("status", DataExportPending)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "requeue stale")
+	}
+
+	ids := make([]uint64, 0)
+	res = s.db.Model(&db.DataExport{}).Where("status = ?", DataExportPending).Pluck("id", &ids)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "find pending")
+	}
+	for _, id := range ids {
+		if err := s.dataExportRun(id); err != nil {
+			return errors.Wrapf(err, "run export %d", id)
+		}
+	}
+	return nil
+}
+
+// dataExportRun builds the archive of a pending export and emails a link to it.
+func (s *General) dataExportRun(id uint64) error {
+	// Claiming the export keeps the request goroutine and the background job from both running it.
+	res := s.db.Model(&db.DataExport{}).
+		Where("id = ? AND status = ?", id, DataExportPending).
+		Update("status", DataExportRunning)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "claim")
+	}
+	if res.RowsAffected == 0 {
+		return nil
+	}
+
+	export := db.DataExport{}
+	res = s.db.Omit("archive").First(&export, id)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "get export")
+	}
+	user := db.User{}
+	res = s.db.First(&user, export.UserID)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "get user")
+	}
+
+	expiresAt := time.Now().Add(s.cfg.DataExportTTL)
+	archive, err := s.dataExportArchive(&user)
+	if err != nil {
+		res = s.db.Model(&export).Updates(map[string]interface{}{
+			"status":     DataExportFailed,
+			"expires_at": expiresAt,
+		})
+		if res.Error != nil {
+			s.logger.Errorw("mark data export failed", "export_id", id, "error", res.Error)
+		}
+		return errors.Wrap(err, "build archive")
+	}
+
+	res = s.db.Model(&export).Updates(map[string]interface{}{
+		"status":     DataExportDone,
+		"archive":    archive,
+		"expires_at": expiresAt,
+	})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "save archive")
+	}
+	export.ExpiresAt = &expiresAt
+
+	link, linkExpiresAt := s.DataExportLink(&export)
+	s.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Bookmarker data export is ready",
+		Body: fmt.Sprintf("The export of your Bookmarker data is ready.\n\n"+
+			"Download it until %s:\n%s\n\n"+
+			"A new link can be requested in the app until %s.\n",
+			linkExpiresAt.UTC().Format(time.RFC1123), link, expiresAt.UTC().Format(time.RFC1123)),
+	})
+	return nil
+}
+
+// dataExportArchive zips the user's profile, bookmarks and tags as JSON files.
+// Attachments are to be added as files of their own next to them.
+func (s *General) dataExportArchive(user *db.User) ([]byte, error) {
+	bookmarks := make([]BookmarkListItem, 0)
+	for cursor := ""; ; {
+		page, next, err := s.BookmarkGet(user, BookmarkFilter{Cursor: cursor})
+		if err != nil {
+			return nil, errors.Wrap(err, "get bookmarks")
+		}
+		bookmarks = append(bookmarks, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	tags, err := s.TagGet(user.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get tags")
+	}
+
+	exportedBookmarks := make([]exportBookmark, len(bookmarks))
+	for i, b := range bookmarks {
+		exportedTags := make([]exportTag, len(b.Tags))
+		for j, t := range b.Tags {
+			exportedTags[j] = exportTag{ID: t.ID, Name: t.Name, CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt}
+		}
+		exportedBookmarks[i] = exportBookmark{
+			ID:          b.ID,
+			Name:        b.Name,
+			Link:        b.Link,
+			Description: b.Description,
+			Tags:        exportedTags,
+			CreatedAt:   b.CreatedAt,
+			UpdatedAt:   b.UpdatedAt,
+		}
+	}
+	exportedTags := make([]exportTag, len(tags))
+	for i, t := range tags {
+		exportedTags[i] = exportTag{ID: t.ID, Name: t.Name, CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt}
+	}
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", exportProfile{
+			ID:               user.ID,
+			Email:            user.Email,
+			EmailVerifiedAt:  user.EmailVerifiedAt,
+			TwoFactorEnabled: user.TOTPEnabledAt != nil,
+			CreatedAt:        user.CreatedAt,
+		}},
+		{"bookmarks.json", exportedBookmarks},
+		{"tags.json", exportedTags},
+	}
+
+	buf := bytes.Buffer{}
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "create %s", f.name)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.content); err != nil {
+			return nil, errors.Wrapf(err, "encode %s", f.name)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "close zip")
+	}
+	return buf.Bytes(), nil
+}
@@ -2,95 +2,329 @@ package service
 
 import (
 	"github.com/Masterminds/squirrel"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
 	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
-	"github.com/google/uuid"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/mailer"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/oidc"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/passhash"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/passpolicy"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/search"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/token"
 	"github.com/pkg/errors"
+	"go.uber.org/fx"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 var (
 	ErrLoginUserNotFound         = errors.New("user not found")
 	ErrLoginPasswordDoesNotMatch = errors.New("password does not match")
+	ErrBookmarkNotFound          = errors.New("bookmark not found")
 )
 
 type General struct {
-	db     *gorm.DB
-	logger *zap.SugaredLogger
+	db              *gorm.DB
+	logger          *zap.SugaredLogger
+	cfg             *config.Config
+	signer          *token.Signer
+	hasher          *passhash.Hasher
+	policy          *passpolicy.Policy
+	revokedSessions *revocationList
+	disabledUsers   *userSet
+	mailer          mailer.Mailer
+	oidcProviders   oidc.Providers
 }
 
-func NewGeneral(db *gorm.DB, l *zap.SugaredLogger) *General {
-	return &General{
-		db:     db,
-		logger: l,
+func NewGeneral(lc fx.Lifecycle, db *gorm.DB, l *zap.SugaredLogger, cfg *config.Config, signer *token.Signer,
+	hasher *passhash.Hasher, policy *passpolicy.Policy, m mailer.Mailer, oidcProviders oidc.Providers) *General {
+	s := &General{
+		db:              db,
+		logger:          l,
+		cfg:             cfg,
+		signer:          signer,
+		hasher:          hasher,
+		policy:          policy,
+		revokedSessions: newRevocationList(),
+		disabledUsers:   newUserSet(),
+		mailer:          m,
+		oidcProviders:   oidcProviders,
 	}
+	s.every(lc, "sync user access", cfg.UserAccessSyncInterval, s.userAccessSync)
+	s.every(lc, "purge deleted accounts", cfg.AccountPurgeInterval, s.accountsPurge)
+	s.every(lc, "process data exports", cfg.DataExportInterval, s.dataExportsProcess)
+	return s
 }
 
-func (s *General) Register(email, pass string) (string, error) {
-	hash, err := s.bcryptGen(pass)
+// Register creates an account and logs it in. A password not meeting the policy is rejected with a *passpolicy.Error.
+func (s *General) Register(email, pass, inviteCode string, client ClientInfo) (pair *TokenPair, err error) {
+	var userID uint64
+	defer func() {
+		// no email is kept, failed attempts are often for someone else's address
+		s.Audit(AuditEntry{Event: AuditRegister, UserID: userID, Client: client, Err: err})
+	}()
+
+	if err := s.registrationCheck(inviteCode); err != nil {
+		return nil, err
+	}
+	if err := s.policy.Check(pass, email); err != nil {
+		return nil, err
+	}
+
+	hash, err := s.hasher.Hash(pass)
 	if err != nil {
-		return "", errors.Wrap(err, "bcryptGen")
+		return nil, errors.Wrap(err, "hash password")
 	}
-	token := uuid.New().String()
-	res := s.db.Create(&db.User{
+
+	var verification *mailer.Message
+	user := db.User{
 		Email:    email,
 		Password: hash,
-		Token:    token,
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if s.cfg.RegistrationMode == config.RegistrationInvite {
+			if err := s.inviteConsume(tx, inviteCode); err != nil {
+				return err
+			}
+		}
+
+		if res := tx.Create(&user); res.Error != nil {
+			return res.Error
+		}
+
+		pair, err = s.sessionCreate(tx, &user, client)
+		if err != nil {
+			return errors.Wrap(err, "create session")
+		}
+
+		verification, err = s.emailVerificationCreate(tx, &user)
+		if err != nil {
+			return errors.Wrap(err, "create verification")
+		}
+		return nil
 	})
-	if res.Error != nil {
-		return "", res.Error
+	if err != nil {
+		return nil, err
 	}
-	return token, nil
+	// only an account which was committed is audited
+	userID = user.ID
+
+	s.sendMail(*verification)
+	return pair, nil
 }
 
-func (s *General) Login(email, pass string) (string, error) {
+// Login checks the password and either opens a session or, with two-factor authentication enabled,
+// returns a challenge to finish with LoginTwoFactor.
+func (s *General) Login(email, pass string, client ClientInfo) (result *LoginResult, err error) {
+	var userID uint64
+	defer func() {
+		entry := AuditEntry{Event: AuditLogin, UserID: userID, Client: client, Err: err}
+		if userID == 0 {
+			entry.Details = "email " + email
+		} else if err == nil && result.Tokens == nil {
+			entry.Details = "second factor required"
+		}
+		s.Audit(entry)
+	}()
+
+	accountKey := loginThrottleAccountKey(email)
+	ipKey := loginThrottleIPKey(client.IP)
+	if err := s.loginThrottleCheck(accountKey, ipKey); err != nil {
+		return nil, err
+	}
+
 	user := db.User{}
 	res := s.db.Where("email = ?", email).First(&user)
 	if res.Error != nil {
 		if res.Error == gorm.ErrRecordNotFound {
-			return "", ErrLoginUserNotFound
+			return nil, s.loginFailed(accountKey, ipKey, ErrLoginUserNotFound)
+		}
+		return nil, res.Error
+	}
+
+	userID = user.ID
+
+	rehash, err := s.hasher.Verify(user.Password, pass)
+	if err != nil {
+		return nil, s.loginFailed(accountKey, ipKey, ErrLoginPasswordDoesNotMatch)
+	}
+	if rehash {
+		s.passwordRehash(&user, pass)
+	}
+
+	if err := s.loginThrottleReset(accountKey); err != nil {
+		return nil, errors.Wrap(err, "reset login throttle")
+	}
+
+	return s.completeLogin(s.db, &user, client)
+}
+
+// loginFailed counts the failure against the account and the IP and returns the reason of the failure.
+func (s *General) loginFailed(accountKey, ipKey string, reason error) error {
+	if err := s.loginThrottleFail(accountKey, s.cfg.LoginAccountMaxFailures); err != nil {
+		return errors.Wrap(err, "throttle account")
+	}
+	if err := s.loginThrottleFail(ipKey, s.cfg.LoginIPMaxFailures); err != nil {
+		return errors.Wrap(err, "throttle ip")
+	}
+	return reason
+}
+
+// BookmarkGet returns a page of the user's bookmarks with their tags matching the filter, oldest first or best
+// first when searching text, and the cursor of the next page, which is empty on the last one. Pages are cut by the
+// position of the last bookmark rather than by offset, so bookmarks added or deleted meanwhile neither shift
+// items into the next page nor repeat them.
+func (s *General) BookmarkGet(user *db.User, f BookmarkFilter) ([]BookmarkListItem, string, error) {
+	if f.Limit == 0 || f.Limit > bookmarkMaxLimit {
+		f.Limit = bookmarkMaxLimit
+	}
+	after, err := decodeBookmarkCursor(f.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	query, err := search.Parse(f.Query)
+	if err != nil {
+		return nil, "", err
+	}
+	filters, text := searchConditions(query)
+	// a cursor of a search doesn't fit the list ordered by ID and the other way round
+	if after != nil && (after.Rank != nil) != (text != "") {
+		return nil, "", ErrBookmarkCursorInvalid
+	}
+
+	q := squirrel.Select("b.id", "b.link", "b.name", "b.description", "b.created_at", "b.updated_at").
+		From("bookmarks b")
+	w := squirrel.And{squirrel.Eq{"b.user_id": user.ID}}
+	w = append(w, f.tagConditions()...)
+	w = append(w, filters...)
+	if text == "" {
+		if after != nil {
+			w = append(w, squirrel.Gt{"b.id": after.ID})
+		}
+		q = q.OrderBy("b.id")
+	} else {
+		w = append(w, squirrel.Expr("b.search @@ websearch_to_tsquery('english', ?)", text))
+		if after != nil {
+			w = append(w, squirrel.Expr("("+bookmarkRank+" < ? OR ("+bookmarkRank+" = ? AND b.id > ?))",
+				text, *after.Rank, text, *after.Rank, after.ID))
+		}
+		q = q.Column(squirrel.Alias(squirrel.Expr(bookmarkRank, text), "rank")).
+			OrderBy("rank DESC", "b.id")
+	}
+	q = q.Where(w).Limit(f.Limit + 1)
+	if text != "" {
+		q = bookmarkHighlights(q, text)
+	}
+
+	sql, args, err := q.ToSql()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "build sql")
+	}
+
+	items := make([]BookmarkListItem, 0)
+	res := s.db.Raw(sql, args...).Scan(&items)
+	if res.Error != nil {
+		return nil, "", errors.Wrap(res.Error, "scan")
+	}
+
+	// the extra row only tells that there is another page
+	var next string
+	if uint64(len(items)) > f.Limit {
+		items = items[:f.Limit]
+		last := items[len(items)-1]
+		cursor := bookmarkCursor{ID: last.ID}
+		if text != "" {
+			cursor.Rank = &last.Rank
 		}
-		return "", res.Error
+		next = encodeBookmarkCursor(cursor)
 	}
 
-	if err := s.bcryptCheck(user.Password, pass); err != nil {
-		return "", ErrLoginPasswordDoesNotMatch
+	for i := range items {
+		items[i].Searched = text != ""
+		items[i].NameHighlight = highlightHTML(items[i].NameHighlight)
+		items[i].DescriptionHighlight = highlightHTML(items[i].DescriptionHighlight)
 	}
+	if err := s.bookmarksWithTags(items); err != nil {
+		return nil, "", err
+	}
+	return items, next, nil
+}
 
-	token := uuid.New().String()
-	res = s.db.Model(&user).Update("token", token)
+// BookmarkGetOne returns a bookmark of the user with its tags. Bookmarks of other users are not found.
+func (s *General) BookmarkGetOne(user *db.User, bookmarkID uint64) (*db.Bookmark, error) {
+	model := db.Bookmark{}
+	res := s.db.Where("user_id = ?", user.ID).First(&model, bookmarkID)
 	if res.Error != nil {
-		return "", errors.Wrap(res.Error, "update token")
+		if res.Error == gorm.ErrRecordNotFound {
+			return nil, ErrBookmarkNotFound
+		}
+		return nil, errors.Wrap(res.Error, "get bookmark")
+	}
+
+	if err := s.bookmarkWithTags(&model); err != nil {
+		return nil, err
 	}
+	return &model, nil
+}
 
-	return token, nil
+func (s *General) bookmarkWithTags(bookmark *db.Bookmark) error {
+	tags, err := s.bookmarkTags([]uint64{bookmark.ID})
+	if err != nil {
+		return errors.Wrap(err, "get tags")
+	}
+	bookmark.Tags = tags[bookmark.ID]
+	return nil
 }
 
-func (s *General) BookmarkGet(user *db.User, tags []uint64) ([]db.Bookmark, error) {
-	w := squirrel.Eq{
-		"b.user_id": user.ID,
+// bookmarksWithTags sets the tags of every bookmark in the slice with a single query.
+func (s *General) bookmarksWithTags(bookmarks []BookmarkListItem) error {
+	ids := make([]uint64, len(bookmarks))
+	for i := range bookmarks {
+		ids[i] = bookmarks[i].ID
+	}
+	tags, err := s.bookmarkTags(ids)
+	if err != nil {
+		return errors.Wrap(err, "get tags")
 	}
-	if len(tags) != 0 {
-		w["tb.tag_id"] = tags
+	for i := range bookmarks {
+		bookmarks[i].Tags = tags[bookmarks[i].ID]
+	}
+	return nil
+}
+
+// bookmarkTags loads the tags of all the bookmarks at once, keyed by bookmark ID.
+func (s *General) bookmarkTags(bookmarkIDs []uint64) (map[uint64][]db.Tag, error) {
+	tags := make(map[uint64][]db.Tag, len(bookmarkIDs))
+	if len(bookmarkIDs) == 0 {
+		return tags, nil
 	}
+
 	sql, args, err := squirrel.
-		Select("b.id", "b.link", "b.name", "b.description").From("bookmarks b").
-		LeftJoin("tag_bookmarks tb ON b.id = tb.bookmark_id").
-		OrderBy("b.id").
-		Where(w).
+		Select("tb.bookmark_id", "t.id", "t.name").From("tag_bookmarks tb").
+		Join("tags t ON t.id = tb.tag_id").
+		Where(squirrel.Eq{"tb.bookmark_id": bookmarkIDs}).
+		OrderBy("t.name").
 		ToSql()
 	if err != nil {
 		return nil, errors.Wrap(err, "build sql")
 	}
 
-	bookmarks := make([]db.Bookmark, 0)
-	res := s.db.Raw(sql, args...).Scan(&bookmarks)
+	rows := make([]struct {
+		BookmarkID uint64
+		ID         uint64
+		Name       string
+	}, 0)
+	res := s.db.Raw(sql, args...).Scan(&rows)
 	if res.Error != nil {
 		return nil, errors.Wrap(res.Error, "scan")
 	}
 
-	return bookmarks, nil
+	for _, r := range rows {
+		tags[r.BookmarkID] = append(tags[r.BookmarkID], db.Tag{
+			GormForkedModel: db.GormForkedModel{ID: r.ID},
+			Name:            r.Name,
+		})
+	}
+	return tags, nil
 }
 
 func (s *General) BookmarkCreate(user *db.User, name, description, link *string, tagIds []uint64) (*db.Bookmark, error) {
@@ -116,6 +350,10 @@ func (s *General) BookmarkCreate(user *db.User, name, description, link *string,
 		return nil, res.Error
 	}
 
+	// the tags were only given by ID
+	if err := s.bookmarkWithTags(&model); err != nil {
+		return nil, err
+	}
 	return &model, nil
 }
 
@@ -150,6 +388,9 @@ func (s *General) BookmarkUpdate(user *db.User, bookmarkID uint64, tagIds []uint
 		return nil, errors.Wrap(res.Error, "get model")
 	}
 
+	if err := s.bookmarkWithTags(&model); err != nil {
+		return nil, err
+	}
 	return &model, nil
 }
 
@@ -215,14 +456,14 @@ func (s *General) TagDelete(id, userID uint64) error {
 	return nil
 }
 
-func (s *General) bcryptGen(pass string) (string, error) {
-	passwordHashB, err := bcrypt.GenerateFromPassword([]byte(pass), 14)
+// passwordRehash replaces a hash made with outdated settings while the password is known.
+// Failing to do so is no reason to fail the login, it is tried again the next time.
+func (s *General) passwordRehash(user *db.User, pass string) {
+	hash, err := s.hasher.Hash(pass)
+	if err == nil {
+		err = s.db.Model(user).Update("password", hash).Error
+	}
 	if err != nil {
-		return "", errors.Wrap(err, "generate password hash")
+		s.logger.Errorw("rehash password", "user_id", user.ID, "error", err)
 	}
-	return string(passwordHashB), nil
-}
-
-func (s *General) bcryptCheck(hash, pass string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
 }
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/token"
+)
+
+var (
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrInviteRequired     = errors.New("an invite code is required to register")
+	ErrInviteInvalid      = errors.New("invite code is invalid, used up or expired")
+	ErrInviteNotFound     = errors.New("invite not found")
+	ErrInviteTooLarge     = errors.New("invite exceeds the allowed uses or lifetime")
+)
+
+// InviteCreate creates an invite good for maxUses registrations within ttl, zero meaning one and InviteTTL.
+// It returns the code in clear along with the invite, the code is not stored and can't be shown again.
+// Admins may create invites of any size, other users only verified ones within the configured limits.
+func (s *General) InviteCreate(userID uint64, maxUses int, ttl time.Duration) (*db.Invite, string, error) {
+	if maxUses == 0 {
+		maxUses = 1
+	}
+	if ttl == 0 {
+		ttl = s.cfg.InviteTTL
+	}
+
+	user := db.User{}
+	res := s.db.First(&user, userID)
+	if res.Error != nil {
+		return nil, "", errors.Wrap(res.Error, "get user")
+	}
+	if user.Role != RoleAdmin {
+		if user.EmailVerifiedAt == nil {
+			return nil, "", ErrEmailNotVerified
+		}
+		if maxUses > s.cfg.InviteMaxUses || ttl > s.cfg.InviteTTL {
+			return nil, "", ErrInviteTooLarge
+		}
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "generate code")
+	}
+
+	model := db.Invite{
+		CodeHash:   s.hashToken(code),
+		CodePrefix: token.Prefix(code),
+		MaxUses:    maxUses,
+		ExpiresAt:  time.Now().Add(ttl),
+		UserID:     userID,
+	}
+	res = s.db.Create(&model)
+	if res.Error != nil {
+		return nil, "", errors.Wrap(res.Error, "create invite")
+	}
+
+	return &model, code, nil
+}
+
+func (s *General) InviteList(userID uint64) ([]db.Invite, error) {
+	invites := make([]db.Invite, 0)
+
+	res := s.db.Where("user_id = ?", userID).Order("id").Find(&invites)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	return invites, nil
+}
+
+// InviteDelete revokes an invite. People who already registered with it keep their accounts.
+func (s *General) InviteDelete(userID, id uint64) error {
+	res := s.db.Where("user_id = ?", userID).Delete(&db.Invite{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// registrationCheck tells whether someone may sign up with the given invite code in the current mode.
+func (s *General) registrationCheck(inviteCode string) error {
+	switch s.cfg.RegistrationMode {
+	case config.RegistrationClosed:
+		return ErrRegistrationClosed
+	case config.RegistrationInvite:
+		if inviteCode == "" {
+			return ErrInviteRequired
+		}
+	}
+	return nil
+}
+
+// inviteConsume uses up one registration of the invite. The check and the increment are a single
+// statement, so concurrent registrations can't use an invite more often than it allows.
+func (s *General) inviteConsume(tx *gorm.DB, code string) error {
+	res := tx.Model(&db.Invite{}).
+		Where("code_hash = ? AND uses < max_uses AND expires_at > ?", s.hashToken(code), time.Now()).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "use invite")
+	}
+	if res.RowsAffected == 0 {
+		return ErrInviteInvalid
+	}
+	return nil
+}
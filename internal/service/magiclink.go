@@ -0,0 +1,89 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/mailer"
+)
+
+var (
+	ErrMagicLinkThrottled = errors.New("a login link was sent to this address recently, try again later")
+)
+
+// MagicLinkRequest emails a login link if the address has an account, and silently does nothing otherwise.
+// Requests for the same address are throttled either way, so that the answer doesn't tell the two apart.
+func (s *General) MagicLinkRequest(email string) error {
+	if err := s.mailThrottle(magicLinkThrottleKey(email), ErrMagicLinkThrottled); err != nil {
+		return err
+	}
+
+	user := db.User{}
+	res := s.db.Where("email = ?", email).First(&user)
+	if res.Error != nil {
+		if res.Error == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return errors.Wrap(res.Error, "get user")
+	}
+
+	t, err := s.oneTimeTokenCreate(s.db, user.ID, oneTimeTokenMagicLink, s.cfg.MagicLinkTTL)
+	if err != nil {
+		return errors.Wrap(err, "create magic link token")
+	}
+
+	s.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Log in to Bookmarker",
+		Body: fmt.Sprintf("Someone asked to log in to your Bookmarker account without a password.\n\n"+
+			"To log in open the link below, it works once and is valid for %s:\n%s\n\n"+
+			"If it wasn't you, just ignore this email.\n",
+			s.cfg.MagicLinkTTL, s.link("/magic-link", t)),
+	})
+	return nil
+}
+
+// MagicLinkLogin exchanges the token from a magic link for a session, or a two-factor challenge.
+// Opening the link proves the user owns the address, so it gets verified too.
+func (s *General) MagicLinkLogin(t string, client ClientInfo) (result *LoginResult, err error) {
+	var userID uint64
+	defer func() {
+		entry := AuditEntry{Event: AuditLoginMagicLink, UserID: userID, Client: client, Err: err}
+		if err == nil && result.Tokens == nil {
+			entry.Details = "second factor required"
+		}
+		s.Audit(entry)
+	}()
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		model, err := s.oneTimeTokenConsume(tx, t, oneTimeTokenMagicLink)
+		if err != nil {
+			return err
+		}
+		userID = model.UserID
+
+		user := db.User{}
+		res := tx.First(&user, model.UserID)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "get user")
+		}
+
+		if user.EmailVerifiedAt == nil {
+			res = tx.Model(&user).Update("email_verified_at", time.Now())
+			if res.Error != nil {
+				return errors.Wrap(res.Error, "verify email")
+			}
+		}
+
+		result, err = s.completeLogin(tx, &user, client)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/oidc"
+)
+
+const (
+	// oidcStateTTL is how long a user has to sign in at the provider.
+	oidcStateTTL = time.Minute * 10
+	// oidcLoginTTL is how long the client app has to exchange the login token it was redirected with.
+	oidcLoginTTL = time.Minute
+)
+
+var (
+	ErrOIDCStateInvalid        = errors.New("sign in expired or was not started here")
+	ErrOIDCExchangeFailed      = errors.New("provider did not accept the sign in")
+	ErrOIDCEmailNotVerified    = errors.New("provider did not confirm the email address")
+	ErrOIDCAccountNotConfirmed = errors.New("an account with this email exists but its email is not verified, log in with the password and verify it first")
+)
+
+// OIDCProviders lists the providers users can sign in with.
+func (s *General) OIDCProviders() []string {
+	return s.oidcProviders.Names()
+}
+
+// OIDCStart begins a sign in with the provider and returns where to send the browser, along with the state
+// the browser has to keep and present again to OIDCCallback.
+func (s *General) OIDCStart(ctx context.Context, providerName string) (authURL, state string, err error) {
+	provider, err := s.oidcProviders.Get(providerName)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err = randomToken()
+	if err != nil {
+		return "", "", errors.Wrap(err, "generate state")
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", errors.Wrap(err, "generate nonce")
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", errors.Wrap(err, "generate code verifier")
+	}
+
+	authURL, err = provider.AuthURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return "", "", errors.Wrap(err, "build auth url")
+	}
+
+	res := s.db.Where("expires_at < ?", time.Now()).Delete(&db.OIDCState{})
+	if res.Error != nil {
+		return "", "", errors.Wrap(res.Error, "delete expired states")
+	}
+
+	res = s.db.Create(&db.OIDCState{
+		State:        state,
+		Provider:     providerName,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	})
+	if res.Error != nil {
+		return "", "", errors.Wrap(res.Error, "save state")
+	}
+
+	return authURL, state, nil
+}
+
+// OIDCCallback finishes a sign in at the provider. It finds the user by the provider account,
+// links the account to a user with the same verified email or creates a new user,
+// and returns a short-lived login token for the client app to exchange with OIDCExchange.
+// browserState is the state OIDCStart gave the browser the callback came from.
+func (s *General) OIDCCallback(ctx context.Context, providerName, state, browserState, code string) (string, error) {
+	provider, err := s.oidcProviders.Get(providerName)
+	if err != nil {
+		return "", err
+	}
+
+	// Without this anyone could send a victim the callback link of a sign in they started
+	// and have the victim's client app logged into their account.
+	if browserState == "" || subtle.ConstantTimeCompare([]byte(state), []byte(browserState)) != 1 {
+		return "", ErrOIDCStateInvalid
+	}
+	saved, err := s.oidcStateConsume(state, providerName)
+	if err != nil {
+		return "", err
+	}
+
+	idToken, err := provider.Exchange(ctx, code, saved.CodeVerifier, saved.Nonce)
+	if err != nil {
+		s.logger.Warnw("oidc code exchange failed", "provider", providerName, "error", err)
+		return "", ErrOIDCExchangeFailed
+	}
+
+	var loginToken string
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		user, err := s.oidcUser(tx, providerName, idToken)
+		if err != nil {
+			return err
+		}
+
+		loginToken, err = s.oneTimeTokenCreate(tx, user.ID, oneTimeTokenOIDCLogin, oidcLoginTTL)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return loginToken, nil
+}
+
+// OIDCExchange turns the login token from OIDCCallback into a session, or a two-factor challenge.
+func (s *General) OIDCExchange(t string, client ClientInfo) (result *LoginResult, err error) {
+	var userID uint64
+	defer func() {
+		entry := AuditEntry{Event: AuditLoginOIDC, UserID: userID, Client: client, Err: err}
+		if err == nil && result.Tokens == nil {
+			entry.Details = "second factor required"
+		}
+		s.Audit(entry)
+	}()
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		model, err := s.oneTimeTokenConsume(tx, t, oneTimeTokenOIDCLogin)
+		if err != nil {
+			return err
+		}
+		userID = model.UserID
+
+		user := db.User{}
+		res := tx.First(&user, model.UserID)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "get user")
+		}
+
+		result, err = s.completeLogin(tx, &user, client)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// oidcStateConsume deletes the saved state so that a callback can't be replayed, and returns it.
+func (s *General) oidcStateConsume(state, providerName string) (*db.OIDCState, error) {
+	saved := db.OIDCState{}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("state = ? AND provider = ?", state, providerName).
+			First(&saved)
+		if res.Error != nil {
+			if res.Error == gorm.ErrRecordNotFound {
+				return ErrOIDCStateInvalid
+			}
+			return errors.Wrap(res.Error, "get state")
+		}
+
+		res = tx.Delete(&saved)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete state")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !time.Now().Before(saved.ExpiresAt) {
+		return nil, ErrOIDCStateInvalid
+	}
+	return &saved, nil
+}
+
+func (s *General) oidcUser(tx *gorm.DB, providerName string, idToken *oidc.IDToken) (*db.User, error) {
+	identity := db.UserIdentity{}
+	res := tx.Preload("User").
+		Where("provider = ? AND subject = ?", providerName, idToken.Subject).
+		First(&identity)
+	if res.Error == nil {
+		return &identity.User, nil
+	}
+	if res.Error != gorm.ErrRecordNotFound {
+		return nil, errors.Wrap(res.Error, "get identity")
+	}
+
+	if idToken.Email == "" || !idToken.EmailVerified {
+		return nil, ErrOIDCEmailNotVerified
+	}
+
+	user := db.User{}
+	res = tx.Where("email = ?", idToken.Email).First(&user)
+	switch {
+	case res.Error == gorm.ErrRecordNotFound:
+		// there is no way to present an invite code through the provider
+		if s.cfg.RegistrationMode != config.RegistrationOpen {
+			return nil, ErrRegistrationClosed
+		}
+		now := time.Now()
+		user = db.User{
+			Email:           idToken.Email,
+			EmailVerifiedAt: &now,
+		}
+		if res := tx.Create(&user); res.Error != nil {
+			return nil, errors.Wrap(res.Error, "create user")
+		}
+	case res.Error != nil:
+		return nil, errors.Wrap(res.Error, "get user by email")
+	case user.EmailVerifiedAt == nil:
+		// whoever registered the address may not own it, linking would let them into the owner's account
+		return nil, ErrOIDCAccountNotConfirmed
+	}
+
+	res = tx.Create(&db.UserIdentity{
+		Provider: providerName,
+		Subject:  idToken.Subject,
+		Email:    idToken.Email,
+		UserID:   user.ID,
+	})
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "create identity")
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/mailer"
+)
+
+const (
+	oneTimeTokenPasswordReset     = "password_reset"
+	oneTimeTokenEmailVerification = "email_verification"
+	oneTimeTokenOIDCLogin         = "oidc_login"
+	oneTimeTokenLoginChallenge    = "login_challenge"
+	oneTimeTokenMagicLink         = "magic_link"
+	oneTimeTokenEmailChange       = "email_change"
+)
+
+var (
+	ErrOneTimeTokenInvalid = errors.New("token is invalid or expired")
+)
+
+// oneTimeTokenCreate stores a new single-use token of the kind and returns it in clear.
+func (s *General) oneTimeTokenCreate(tx *gorm.DB, userID uint64, kind string, ttl time.Duration) (string, error) {
+	return s.oneTimeTokenCreateWithPayload(tx, userID, kind, "", ttl)
+}
+
+func (s *General) oneTimeTokenCreateWithPayload(tx *gorm.DB, userID uint64, kind, payload string, ttl time.Duration) (string, error) {
+	t, err := randomToken()
+	if err != nil {
+		return "", errors.Wrap(err, "generate token")
+	}
+
+	res := tx.Create(&db.OneTimeToken{
+		TokenHash: s.hashToken(t),
+		Kind:      kind,
+		Payload:   payload,
+		ExpiresAt: time.Now().Add(ttl),
+		UserID:    userID,
+	})
+	if res.Error != nil {
+		return "", errors.Wrap(res.Error, "create token")
+	}
+	return t, nil
+}
+
+// oneTimeTokenConsume marks the token used. It must run in a transaction together
+// with whatever the token authorizes, so that a failure leaves the token usable.
+func (s *General) oneTimeTokenConsume(tx *gorm.DB, t, kind string) (*db.OneTimeToken, error) {
+	model, err := s.oneTimeTokenGet(tx, t, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	res := tx.Model(model).UpdateColumn("used_at", time.Now())
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "mark token used")
+	}
+	return model, nil
+}
+
+// oneTimeTokensRevoke marks the unused tokens of the user of the kinds used, or all of them without kinds.
+func (s *General) oneTimeTokensRevoke(tx *gorm.DB, userID uint64, kinds ...string) error {
+	q := tx.Model(&db.OneTimeToken{}).Where("user_id = ? AND used_at IS NULL", userID)
+	if len(kinds) != 0 {
+		q = q.Where("kind IN ?", kinds)
+	}
+	res := q.UpdateColumn("used_at", time.Now())
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "revoke tokens")
+	}
+	return nil
+}
+
+// oneTimeTokenGet returns the token if it can still be used, locking it until the transaction ends.
+func (s *General) oneTimeTokenGet(tx *gorm.DB, t, kind string) (*db.OneTimeToken, error) {
+	model := db.OneTimeToken{}
+	res := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("token_hash = ? AND kind = ?", s.hashToken(t), kind).
+		First(&model)
+	if res.Error != nil {
+		if res.Error == gorm.ErrRecordNotFound {
+			return nil, ErrOneTimeTokenInvalid
+		}
+		return nil, errors.Wrap(res.Error, "get token")
+	}
+
+	if model.UsedAt != nil || !time.Now().Before(model.ExpiresAt) {
+		return nil, ErrOneTimeTokenInvalid
+	}
+	return &model, nil
+}
+
+// sendMail delivers the message in the background, mail problems are only logged
+// so that responses don't tell whether an address has an account.
+func (s *General) sendMail(msg mailer.Message) {
+	go func() {
+		if err := s.mailer.Send(msg); err != nil {
+			s.logger.Errorw("failed to send mail", "error", err, "to", msg.To, "subject", msg.Subject)
+		}
+	}()
+}
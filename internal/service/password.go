@@ -0,0 +1,172 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/mailer"
+)
+
+var (
+	ErrPasswordDoesNotMatch   = errors.New("current password does not match")
+	ErrPasswordNotSet         = errors.New("account has no password, set one with a password reset first")
+	ErrPasswordResetThrottled = errors.New("a reset link was sent to this address recently, try again later")
+)
+
+// PasswordChange sets a new password, revokes emailed login links and logs out every other session of the user.
+// A wrong current password counts as a failed login.
+func (s *General) PasswordChange(userID, sessionID uint64, current, new string, client ClientInfo) error {
+	user := db.User{}
+	res := s.db.First(&user, userID)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "get user")
+	}
+
+	accountKey := loginThrottleAccountKey(user.Email)
+	ipKey := loginThrottleIPKey(client.IP)
+	if err := s.loginThrottleCheck(accountKey, ipKey); err != nil {
+		return err
+	}
+	if err := s.passwordCheck(&user, current); err != nil {
+		if errors.Is(err, ErrPasswordDoesNotMatch) {
+			return s.loginFailed(accountKey, ipKey, err)
+		}
+		return err
+	}
+	if err := s.loginThrottleReset(accountKey); err != nil {
+		return errors.Wrap(err, "reset login throttle")
+	}
+	if err := s.policy.Check(new, user.Email); err != nil {
+		return err
+	}
+
+	hash, err := s.hasher.Hash(new)
+	if err != nil {
+		return errors.Wrap(err, "hash password")
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&user).Update("password", hash)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "update password")
+		}
+		return s.passwordLinksRevoke(tx, userID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.SessionDeleteOthers(userID, sessionID); err != nil {
+		return errors.Wrap(err, "revoke other sessions")
+	}
+	return nil
+}
+
+// PasswordResetRequest emails a reset link if the address has an account, and silently does nothing otherwise.
+// Requests for the same address are throttled like magic links.
+func (s *General) PasswordResetRequest(email string) error {
+	if err := s.mailThrottle(passwordResetThrottleKey(email), ErrPasswordResetThrottled); err != nil {
+		return err
+	}
+
+	user := db.User{}
+	res := s.db.Where("email = ?", email).First(&user)
+	if res.Error != nil {
+		if res.Error == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return errors.Wrap(res.Error, "get user")
+	}
+
+	t, err := s.oneTimeTokenCreate(s.db, user.ID, oneTimeTokenPasswordReset, s.cfg.PasswordResetTTL)
+	if err != nil {
+		return errors.Wrap(err, "create reset token")
+	}
+
+	s.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Bookmarker password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Bookmarker account.\n\n"+
+			"To choose a new password open the link below, it is valid for %s:\n%s\n\n"+
+			"If it wasn't you, just ignore this email.\n",
+			s.cfg.PasswordResetTTL, s.link("/reset-password", t)),
+	})
+	return nil
+}
+
+// PasswordReset sets a new password using an emailed reset token, revokes the other emailed login links
+// and logs out every session of the user.
+func (s *General) PasswordReset(t, new string, client ClientInfo) (err error) {
+	var userID uint64
+	defer func() {
+		// an unknown token says nothing about any account
+		if userID != 0 {
+			s.Audit(AuditEntry{Event: AuditPasswordReset, UserID: userID, Client: client, Err: err})
+		}
+	}()
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		model, err := s.oneTimeTokenConsume(tx, t, oneTimeTokenPasswordReset)
+		if err != nil {
+			return err
+		}
+		userID = model.UserID
+
+		user := db.User{}
+		res := tx.First(&user, model.UserID)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "get user")
+		}
+		// a rejected password rolls the transaction back, leaving the token usable for another try
+		if err := s.policy.Check(new, user.Email); err != nil {
+			return err
+		}
+
+		hash, err := s.hasher.Hash(new)
+		if err != nil {
+			return errors.Wrap(err, "hash password")
+		}
+		res = tx.Model(&user).Update("password", hash)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "update password")
+		}
+		return s.passwordLinksRevoke(tx, model.UserID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.sessionsDelete(s.db.Where("user_id = ?", userID)); err != nil {
+		return errors.Wrap(err, "revoke sessions")
+	}
+	return nil
+}
+
+// passwordLinksRevoke stops the reset and magic links mailed to the user from working. They aren't needed
+// once the password changed, and one that leaked would get around the new password.
+func (s *General) passwordLinksRevoke(tx *gorm.DB, userID uint64) error {
+	if err := s.oneTimeTokensRevoke(tx, userID, oneTimeTokenPasswordReset, oneTimeTokenMagicLink); err != nil {
+		return errors.Wrap(err, "revoke password links")
+	}
+	return nil
+}
+
+// passwordCheck confirms a sensitive action with the user's password. Accounts created through an OIDC
+// provider have none until they set one with a password reset.
+func (s *General) passwordCheck(user *db.User, password string) error {
+	if user.Password == "" {
+		return ErrPasswordNotSet
+	}
+	if _, err := s.hasher.Verify(user.Password, password); err != nil {
+		return ErrPasswordDoesNotMatch
+	}
+	return nil
+}
+
+// link builds a link into the client app carrying a token.
+func (s *General) link(path, t string) string {
+	return fmt.Sprintf("%s%s?token=%s", s.cfg.PublicURL, path, url.QueryEscape(t))
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// revocationList remembers revoked sessions until the access tokens issued for them expire,
+// so that logging out takes effect immediately although access tokens are checked without the database.
+// Revocations are stored in the database too, and userAccessSync merges those of other instances in.
+type revocationList struct {
+	mu    sync.RWMutex
+	until map[uint64]time.Time
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		until: map[uint64]time.Time{},
+	}
+}
+
+func (r *revocationList) Add(id uint64, until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.until[id] = until
+}
+
+// Merge adds the revocations and forgets those whose tokens expired. Entries missing from them are kept,
+// since revocations are never undone.
+func (r *revocationList) Merge(until map[uint64]time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, t := range until {
+		r.until[id] = t
+	}
+	now := time.Now()
+	for id, t := range r.until {
+		if now.After(t) {
+			delete(r.until, id)
+		}
+	}
+}
+
+// Has is called for every authenticated request, so it only reads.
+func (r *revocationList) Has(id uint64) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.until[id]
+	return ok
+}
@@ -0,0 +1,301 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/token"
+)
+
+var (
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrAccessTokenInvalid  = errors.New("access token is invalid")
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+type (
+	// ClientInfo describes the device a request came from.
+	ClientInfo struct {
+		IP        string
+		UserAgent string
+	}
+
+	TokenPair struct {
+		AccessToken          string
+		AccessTokenExpiresAt time.Time
+		RefreshToken         string
+	}
+)
+
+// Authenticate verifies an access token without touching the database.
+func (s *General) Authenticate(accessToken string) (*token.Claims, error) {
+	claims, err := s.signer.Verify(accessToken)
+	if err != nil {
+		return nil, ErrAccessTokenInvalid
+	}
+	if s.revokedSessions.Has(claims.SessionID) {
+		return nil, ErrAccessTokenInvalid
+	}
+	if s.disabledUsers.Has(claims.UserID) {
+		return nil, ErrUserDisabled
+	}
+	return claims, nil
+}
+
+// Refresh exchanges a refresh token for a new token pair of the same session.
+// Presenting an already used refresh token revokes the whole session.
+func (s *General) Refresh(refreshToken string, client ClientInfo) (*TokenPair, error) {
+	var (
+		pair           *TokenPair
+		reusedInUserID uint64
+		reusedInID     uint64
+	)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		model := db.RefreshToken{}
+		res := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token_hash = ?", s.hashToken(refreshToken)).First(&model)
+		if res.Error != nil {
+			if res.Error == gorm.ErrRecordNotFound {
+				return ErrRefreshTokenInvalid
+			}
+			return errors.Wrap(res.Error, "get refresh token")
+		}
+
+		session := db.Session{}
+		res = tx.Preload("User").First(&session, model.SessionID)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "get session")
+		}
+
+		if model.UsedAt != nil {
+			reusedInUserID = session.UserID
+			reusedInID = session.ID
+			return nil
+		}
+		now := time.Now()
+		if !now.Before(model.ExpiresAt) {
+			return ErrRefreshTokenInvalid
+		}
+
+		res = tx.Model(&model).UpdateColumn("used_at", now)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "mark refresh token used")
+		}
+		res = tx.Model(&session).UpdateColumns(map[string]interface{}{
+			"last_used_at": now,
+			"ip":           client.IP,
+			"user_agent":   client.UserAgent,
+		})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "touch session")
+		}
+
+		var err error
+		pair, err = s.issueTokens(tx, &session.User, &session)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if reusedInID != 0 {
+		s.logger.Warnw("refresh token reuse detected, revoking session",
+			"user_id", reusedInUserID,
+			"session_id", reusedInID,
+			"ip", client.IP,
+		)
+		if err := s.SessionDelete(reusedInUserID, reusedInID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return nil, errors.Wrap(err, "revoke session")
+		}
+		s.Audit(AuditEntry{
+			Event:   AuditRefreshReuse,
+			UserID:  reusedInUserID,
+			Client:  client,
+			Err:     ErrRefreshTokenReused,
+			Details: fmt.Sprintf("session %d revoked", reusedInID),
+		})
+		return nil, ErrRefreshTokenReused
+	}
+
+	return pair, nil
+}
+
+func (s *General) SessionList(userID uint64) ([]db.Session, error) {
+	sessions := make([]db.Session, 0)
+
+	res := s.db.Where("user_id = ?", userID).Order("last_used_at DESC").Find(&sessions)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	return sessions, nil
+}
+
+// SessionDelete revokes a single session of the user.
+func (s *General) SessionDelete(userID, sessionID uint64) error {
+	var until time.Time
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("user_id = ?", userID).Delete(&db.Session{}, sessionID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrSessionNotFound
+		}
+
+		var err error
+		until, err = s.sessionsRevoke(tx, []uint64{sessionID})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.revokedSessions.Add(sessionID, until)
+	return nil
+}
+
+// SessionDeleteOthers revokes every session of the user except the one given.
+func (s *General) SessionDeleteOthers(userID, keepSessionID uint64) error {
+	return s.sessionsDelete(s.db.Where("user_id = ? AND id <> ?", userID, keepSessionID))
+}
+
+// sessionsDelete revokes every session matched by the scope.
+func (s *General) sessionsDelete(scope *gorm.DB) error {
+	ids := make([]uint64, 0)
+	res := scope.Model(&db.Session{}).Pluck("id", &ids)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "find sessions")
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var until time.Time
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(&db.Session{}, ids)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete sessions")
+		}
+
+		var err error
+		until, err = s.sessionsRevoke(tx, ids)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		s.revokedSessions.Add(id, until)
+	}
+	return nil
+}
+
+// sessionsRevoke stores the revocation of the deleted sessions for the other instances and returns until when
+// it lasts. Callers add the sessions to revokedSessions once the transaction is committed.
+func (s *General) sessionsRevoke(tx *gorm.DB, ids []uint64) (time.Time, error) {
+	until := time.Now().Add(s.signer.TTL())
+	if len(ids) == 0 {
+		return until, nil
+	}
+
+	rows := make([]db.RevokedSession, len(ids))
+	for i, id := range ids {
+		rows[i] = db.RevokedSession{SessionID: id, ExpiresAt: until}
+	}
+	res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows)
+	if res.Error != nil {
+		return until, errors.Wrap(res.Error, "store revoked sessions")
+	}
+	return until, nil
+}
+
+// revokedSessionsSync loads the sessions revoked by any instance and forgets those whose tokens expired.
+func (s *General) revokedSessionsSync() error {
+	res := s.db.Where("expires_at <= ?", time.Now()).Delete(&db.RevokedSession{})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "delete expired revocations")
+	}
+
+	rows := make([]db.RevokedSession, 0)
+	res = s.db.Find(&rows)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "find revoked sessions")
+	}
+	until := make(map[uint64]time.Time, len(rows))
+	for _, r := range rows {
+		until[r.SessionID] = r.ExpiresAt
+	}
+	s.revokedSessions.Merge(until)
+	return nil
+}
+
+func (s *General) sessionCreate(tx *gorm.DB, user *db.User, client ClientInfo) (*TokenPair, error) {
+	session := db.Session{
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+		LastUsedAt: time.Now(),
+		UserID:     user.ID,
+	}
+	res := tx.Create(&session)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return s.issueTokens(tx, user, &session)
+}
+
+// issueTokens is where every login and refresh ends up, so it is where disabled users are stopped.
+func (s *General) issueTokens(tx *gorm.DB, user *db.User, session *db.Session) (*TokenPair, error) {
+	if user.DisabledAt != nil {
+		return nil, ErrUserDisabled
+	}
+
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate refresh token")
+	}
+	res := tx.Create(&db.RefreshToken{
+		TokenHash:   s.hashToken(refreshToken),
+		TokenPrefix: token.Prefix(refreshToken),
+		ExpiresAt:   time.Now().Add(s.cfg.RefreshTokenTTL),
+		SessionID:   session.ID,
+	})
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "create refresh token")
+	}
+
+	accessToken, expiresAt, err := s.signer.Sign(token.Claims{
+		UserID:        user.ID,
+		SessionID:     session.ID,
+		EmailVerified: user.EmailVerifiedAt != nil,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "sign access token")
+	}
+
+	return &TokenPair{
+		AccessToken:          accessToken,
+		AccessTokenExpiresAt: expiresAt,
+		RefreshToken:         refreshToken,
+	}, nil
+}
+
+// hashToken returns the form an opaque token is stored and looked up in.
+func (s *General) hashToken(t string) string {
+	return token.Hash([]byte(s.cfg.TokenHashKey), t)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+)
+
+// LoginLockedError is returned while an account or IP is locked out after too many failed logins.
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func loginThrottleAccountKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func loginThrottleIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func magicLinkThrottleKey(email string) string {
+	return "magic_link:" + strings.ToLower(email)
+}
+
+func passwordResetThrottleKey(email string) string {
+	return "password_reset:" + strings.ToLower(email)
+}
+
+// loginThrottleCheck returns LoginLockedError if any of the keys is locked out.
+func (s *General) loginThrottleCheck(keys ...string) error {
+	throttles := make([]db.LoginThrottle, 0)
+	res := s.db.Where("key IN ? AND locked_until > ?", keys, time.Now()).Find(&throttles)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "get throttles")
+	}
+
+	var retryAfter time.Duration
+	for i := range throttles {
+		if d := time.Until(*throttles[i].LockedUntil); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter > 0 {
+		return &LoginLockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// loginThrottleFail counts a failed login for the key and locks it out once maxFailures is reached.
+func (s *General) loginThrottleFail(key string, maxFailures int) error {
+	now := time.Now()
+
+	var failures int
+	res := s.db.Raw(`INSERT INTO login_throttles (key, failures, last_failure_at, created_at, updated_at)
+		VALUES (?, 1, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at,
+			updated_at = EXCLUDED.updated_at
+		RETURNING failures`,
+		key, now, now, now, now.Add(-s.cfg.LoginFailureWindow)).Scan(&failures)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "count failure")
+	}
+	if failures < maxFailures {
+		return nil
+	}
+
+	lockout := s.cfg.LoginLockoutBase
+	for i := maxFailures; i < failures && lockout < s.cfg.LoginLockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > s.cfg.LoginLockoutMax {
+		lockout = s.cfg.LoginLockoutMax
+	}
+
+	res = s.db.Model(&db.LoginThrottle{}).Where("key = ?", key).Update("locked_until", now.Add(lockout))
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "lock out")
+	}
+
+	s.logger.Warnw("login locked out after failed attempts",
+		"key", key,
+		"failures", failures,
+		"lockout", lockout.String(),
+	)
+	return nil
+}
+
+// loginThrottleReset forgets the failures of the key after a successful login.
+func (s *General) loginThrottleReset(key string) error {
+	res := s.db.Where("key = ?", key).Delete(&db.LoginThrottle{})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "delete throttle")
+	}
+	return nil
+}
+
+// mailThrottle returns throttled if a mail was requested for the key within MagicLinkInterval,
+// which keeps links from being used to flood an address. The throttle shares the login throttles
+// table, where the time of the last request is kept as the last failure.
+func (s *General) mailThrottle(key string, throttled error) error {
+	now := time.Now()
+
+	ids := make([]uint64, 0)
+	res := s.db.Raw(`INSERT INTO login_throttles (key, failures, last_failure_at, created_at, updated_at)
+		VALUES (?, 0, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			last_failure_at = EXCLUDED.last_failure_at,
+			updated_at = EXCLUDED.updated_at
+		WHERE login_throttles.last_failure_at <= ?
+		RETURNING id`,
+		key, now, now, now, now.Add(-s.cfg.MagicLinkInterval)).Scan(&ids)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "throttle")
+	}
+	if len(ids) == 0 {
+		return throttled
+	}
+	return nil
+}
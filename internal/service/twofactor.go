@@ -0,0 +1,282 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/totp"
+)
+
+const (
+	totpIssuer = "Bookmarker"
+	// loginChallengeTTL is how long a user has to enter the second factor after the password.
+	loginChallengeTTL  = time.Minute * 5
+	recoveryCodesCount = 10
+)
+
+var (
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled  = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotEnrolled = errors.New("two-factor authentication enrollment was not started")
+	ErrTwoFactorCodeInvalid = errors.New("code is invalid")
+)
+
+type LoginResult struct {
+	Tokens *TokenPair
+	// ChallengeToken is set instead of Tokens when the user has to enter a second factor, see LoginTwoFactor.
+	ChallengeToken string
+}
+
+// LoginTwoFactor finishes a login started with a password by checking either a TOTP code or a recovery code.
+// Wrong codes count as failed logins.
+func (s *General) LoginTwoFactor(challenge, code, recoveryCode string, client ClientInfo) (pair *TokenPair, err error) {
+	var (
+		userID     uint64
+		failedUser *db.User
+	)
+	defer func() {
+		s.Audit(AuditEntry{Event: AuditLoginTwoFactor, UserID: userID, Client: client, Err: err})
+	}()
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		model, err := s.oneTimeTokenGet(tx, challenge, oneTimeTokenLoginChallenge)
+		if err != nil {
+			return err
+		}
+		userID = model.UserID
+
+		user := db.User{}
+		res := tx.First(&user, model.UserID)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "get user")
+		}
+
+		if err := s.loginThrottleCheck(loginThrottleAccountKey(user.Email), loginThrottleIPKey(client.IP)); err != nil {
+			return err
+		}
+
+		ok, err := s.secondFactorCheck(tx, &user, code, recoveryCode)
+		if err != nil {
+			return errors.Wrap(err, "check second factor")
+		}
+		if !ok {
+			failedUser = &user
+			return nil
+		}
+
+		if _, err := s.oneTimeTokenConsume(tx, challenge, oneTimeTokenLoginChallenge); err != nil {
+			return err
+		}
+		pair, err = s.sessionCreate(tx, &user, client)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if failedUser != nil {
+		return nil, s.loginFailed(loginThrottleAccountKey(failedUser.Email), loginThrottleIPKey(client.IP), ErrTwoFactorCodeInvalid)
+	}
+	return pair, nil
+}
+
+// TwoFactorEnroll generates a new TOTP secret for the user. It is not used until confirmed with TwoFactorConfirm.
+func (s *General) TwoFactorEnroll(userID uint64) (secret, uri string, err error) {
+	user := db.User{}
+	res := s.db.First(&user, userID)
+	if res.Error != nil {
+		return "", "", errors.Wrap(res.Error, "get user")
+	}
+	if user.TOTPEnabledAt != nil {
+		return "", "", ErrTwoFactorEnabled
+	}
+
+	secret, err = totp.GenerateSecret()
+	if err != nil {
+		return "", "", errors.Wrap(err, "generate secret")
+	}
+	res = s.db.Model(&user).Update("totp_secret", secret)
+	if res.Error != nil {
+		return "", "", errors.Wrap(res.Error, "save secret")
+	}
+
+	return secret, totp.URI(totpIssuer, user.Email, secret), nil
+}
+
+// TwoFactorConfirm enables two-factor authentication once the user proves the authenticator app works,
+// and returns a fresh set of recovery codes, which are only stored hashed.
+func (s *General) TwoFactorConfirm(userID uint64, code string) ([]string, error) {
+	var codes []string
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		user := db.User{}
+		res := tx.First(&user, userID)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "get user")
+		}
+		if user.TOTPEnabledAt != nil {
+			return ErrTwoFactorEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrTwoFactorNotEnrolled
+		}
+
+		step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !ok {
+			return ErrTwoFactorCodeInvalid
+		}
+
+		res = tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled_at": time.Now(),
+			"totp_last_step":  step,
+		})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "enable")
+		}
+
+		var err error
+		codes, err = s.recoveryCodesCreate(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// TwoFactorDisable turns two-factor authentication off, given a current TOTP code or a recovery code.
+// Wrong codes count as failed logins, like in LoginTwoFactor.
+func (s *General) TwoFactorDisable(userID uint64, code, recoveryCode string, client ClientInfo) error {
+	var failedUser *db.User
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		user := db.User{}
+		res := tx.First(&user, userID)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "get user")
+		}
+		if user.TOTPEnabledAt == nil {
+			return ErrTwoFactorNotEnabled
+		}
+
+		if err := s.loginThrottleCheck(loginThrottleAccountKey(user.Email), loginThrottleIPKey(client.IP)); err != nil {
+			return err
+		}
+
+		ok, err := s.secondFactorCheck(tx, &user, code, recoveryCode)
+		if err != nil {
+			return errors.Wrap(err, "check second factor")
+		}
+		if !ok {
+			failedUser = &user
+			return nil
+		}
+
+		res = tx.Model(&user).Updates(map[string]interface{}{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "disable")
+		}
+		res = tx.Where("user_id = ?", userID).Delete(&db.RecoveryCode{})
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "delete recovery codes")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if failedUser != nil {
+		return s.loginFailed(loginThrottleAccountKey(failedUser.Email), loginThrottleIPKey(client.IP), ErrTwoFactorCodeInvalid)
+	}
+	return nil
+}
+
+// completeLogin opens a session for a user who proved their identity,
+// unless they still have to enter a second factor.
+func (s *General) completeLogin(tx *gorm.DB, user *db.User, client ClientInfo) (*LoginResult, error) {
+	if user.TOTPEnabledAt != nil {
+		challenge, err := s.oneTimeTokenCreate(tx, user.ID, oneTimeTokenLoginChallenge, loginChallengeTTL)
+		if err != nil {
+			return nil, errors.Wrap(err, "create challenge")
+		}
+		return &LoginResult{ChallengeToken: challenge}, nil
+	}
+
+	pair, err := s.sessionCreate(tx, user, client)
+	if err != nil {
+		return nil, errors.Wrap(err, "create session")
+	}
+	return &LoginResult{Tokens: pair}, nil
+}
+
+// secondFactorCheck accepts a TOTP code not used before or an unused recovery code, using it up.
+func (s *General) secondFactorCheck(tx *gorm.DB, user *db.User, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+		if !ok || step <= user.TOTPLastStep {
+			return false, nil
+		}
+		res := tx.Model(user).Update("totp_last_step", step)
+		if res.Error != nil {
+			return false, errors.Wrap(res.Error, "save step")
+		}
+		return true, nil
+	}
+
+	if recoveryCode != "" {
+		res := tx.Model(&db.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, s.hashToken(normalizeRecoveryCode(recoveryCode))).
+			Update("used_at", time.Now())
+		if res.Error != nil {
+			return false, errors.Wrap(res.Error, "use recovery code")
+		}
+		return res.RowsAffected != 0, nil
+	}
+
+	return false, nil
+}
+
+func (s *General) recoveryCodesCreate(tx *gorm.DB, userID uint64) ([]string, error) {
+	res := tx.Where("user_id = ?", userID).Delete(&db.RecoveryCode{})
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "delete old codes")
+	}
+
+	codes := make([]string, recoveryCodesCount)
+	models := make([]db.RecoveryCode, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, errors.Wrap(err, "read random")
+		}
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = c[0:4] + "-" + c[4:8] + "-" + c[8:12] + "-" + c[12:16]
+		models[i] = db.RecoveryCode{
+			CodeHash: s.hashToken(normalizeRecoveryCode(codes[i])),
+			UserID:   userID,
+		}
+	}
+
+	res = tx.Create(&models)
+	if res.Error != nil {
+		return nil, errors.Wrap(res.Error, "create codes")
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode lets users type recovery codes in any case, with or without dashes.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
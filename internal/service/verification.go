@@ -0,0 +1,104 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/mailer"
+)
+
+var (
+	ErrEmailAlreadyVerified       = errors.New("email is already verified")
+	ErrEmailVerificationThrottled = errors.New("verification email was sent recently, try again later")
+	ErrEmailNotVerified           = errors.New("email is not verified")
+)
+
+// EmailVerify marks the email of the user the verification token was sent to as verified.
+func (s *General) EmailVerify(t string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		model, err := s.oneTimeTokenConsume(tx, t, oneTimeTokenEmailVerification)
+		if err != nil {
+			return err
+		}
+
+		res := tx.Model(&db.User{}).
+			Where("id = ? AND email_verified_at IS NULL", model.UserID).
+			Update("email_verified_at", time.Now())
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "update user")
+		}
+		return nil
+	})
+}
+
+// EmailVerificationResend sends a new verification email unless one was sent recently.
+func (s *General) EmailVerificationResend(userID uint64) error {
+	user := db.User{}
+	res := s.db.First(&user, userID)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "get user")
+	}
+	if user.EmailVerifiedAt != nil {
+		return ErrEmailAlreadyVerified
+	}
+
+	var last []time.Time
+	res = s.db.Model(&db.OneTimeToken{}).
+		Where("user_id = ? AND kind = ?", userID, oneTimeTokenEmailVerification).
+		Order("created_at DESC").Limit(1).
+		Pluck("created_at", &last)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "get last verification")
+	}
+	if len(last) != 0 && time.Since(last[0]) < s.cfg.EmailVerificationResendInterval {
+		return ErrEmailVerificationThrottled
+	}
+
+	msg, err := s.emailVerificationCreate(s.db, &user)
+	if err != nil {
+		return errors.Wrap(err, "create verification")
+	}
+	s.sendMail(*msg)
+	return nil
+}
+
+// WriteAllowed tells whether the user may change data, which depends on the email verification.
+func (s *General) WriteAllowed(userID uint64) error {
+	if s.cfg.UnverifiedAccess == config.UnverifiedAccessFull {
+		return nil
+	}
+
+	user := db.User{}
+	res := s.db.Select("id", "created_at", "email_verified_at").First(&user, userID)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "get user")
+	}
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+	if s.cfg.UnverifiedAccess == config.UnverifiedAccessGrace &&
+		time.Since(user.CreatedAt) < s.cfg.UnverifiedGracePeriod {
+		return nil
+	}
+	return ErrEmailNotVerified
+}
+
+func (s *General) emailVerificationCreate(tx *gorm.DB, user *db.User) (*mailer.Message, error) {
+	t, err := s.oneTimeTokenCreate(tx, user.ID, oneTimeTokenEmailVerification, s.cfg.EmailVerificationTTL)
+	if err != nil {
+		return nil, errors.Wrap(err, "create verification token")
+	}
+
+	return &mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your Bookmarker email",
+		Body: fmt.Sprintf("Welcome to Bookmarker!\n\n"+
+			"Please confirm your email address by opening the link below, it is valid for %s:\n%s\n",
+			s.cfg.EmailVerificationTTL, s.link("/verify", t)),
+	}, nil
+}
@@ -0,0 +1,26 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// prefixLength is how much of an opaque token is kept in clear to tell tokens apart.
+const prefixLength = 8
+
+// Hash returns the keyed hash under which an opaque token is stored and looked up.
+// A database dump alone is not enough to forge it back into a usable token.
+func Hash(key []byte, token string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Prefix returns the part of an opaque token that is safe to store and display.
+func Prefix(token string) string {
+	if len(token) <= prefixLength {
+		return ""
+	}
+	return token[:prefixLength]
+}
@@ -0,0 +1,20 @@
+package token
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHash(t *testing.T) {
+	h := Hash([]byte("key"), "token")
+	assert.Len(t, h, 64)
+	assert.Equal(t, h, Hash([]byte("key"), "token"))
+	assert.NotEqual(t, h, Hash([]byte("other key"), "token"))
+	assert.NotEqual(t, h, Hash([]byte("key"), "other token"))
+}
+
+func TestPrefix(t *testing.T) {
+	assert.Equal(t, "abcdefgh", Prefix("abcdefghijklmnop"))
+	assert.Equal(t, "", Prefix("short"))
+}
@@ -0,0 +1,167 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
+)
+
+const algHS256 = "HS256"
+
+var (
+	ErrInvalid = errors.New("invalid token")
+	ErrExpired = errors.New("token expired")
+)
+
+type (
+	// Claims is what an access token asserts about its bearer.
+	Claims struct {
+		UserID        uint64
+		SessionID     uint64
+		EmailVerified bool
+		IssuedAt      time.Time
+		ExpiresAt     time.Time
+	}
+
+	header struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+		Kid string `json:"kid"`
+	}
+
+	payload struct {
+		Sub string `json:"sub"`
+		Sid uint64 `json:"sid"`
+		Evf bool   `json:"evf,omitempty"`
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+	}
+
+	// Signer issues and verifies HS256 JWT access tokens.
+	// Tokens carry the id of the key they were signed with, so keys can be rotated
+	// by adding a new one, switching the active id and removing the old one after a TTL.
+	Signer struct {
+		keys        map[string][]byte
+		activeKeyID string
+		ttl         time.Duration
+		now         func() time.Time
+	}
+)
+
+func NewSigner(cfg *config.Config) (*Signer, error) {
+	keys, err := cfg.SigningKeys()
+	if err != nil {
+		return nil, errors.Wrap(err, "parse signing keys")
+	}
+	return &Signer{
+		keys:        keys,
+		activeKeyID: cfg.AuthSigningKeyID,
+		ttl:         cfg.AccessTokenTTL,
+		now:         time.Now,
+	}, nil
+}
+
+// Sign issues an access token with the claims and returns it with its expiration time.
+// Issue and expiration times of the claims are ignored.
+func (s *Signer) Sign(claims Claims) (string, time.Time, error) {
+	now := s.now()
+	expiresAt := now.Add(s.ttl)
+
+	headerB, err := json.Marshal(&header{Alg: algHS256, Typ: "JWT", Kid: s.activeKeyID})
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "marshal header")
+	}
+	payloadB, err := json.Marshal(&payload{
+		Sub: strconv.FormatUint(claims.UserID, 10),
+		Sid: claims.SessionID,
+		Evf: claims.EmailVerified,
+		Iat: now.Unix(),
+		Exp: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "marshal payload")
+	}
+
+	signingInput := encode(headerB) + "." + encode(payloadB)
+	return signingInput + "." + encode(sign(s.keys[s.activeKeyID], signingInput)), expiresAt, nil
+}
+
+// Verify checks the signature and expiration of an access token.
+func (s *Signer) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalid
+	}
+
+	h := header{}
+	if err := decodeJSON(parts[0], &h); err != nil {
+		return nil, ErrInvalid
+	}
+	if h.Alg != algHS256 {
+		return nil, ErrInvalid
+	}
+	key, ok := s.keys[h.Kid]
+	if !ok {
+		return nil, ErrInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	if !hmac.Equal(signature, sign(key, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalid
+	}
+
+	p := payload{}
+	if err := decodeJSON(parts[1], &p); err != nil {
+		return nil, ErrInvalid
+	}
+	userID, err := strconv.ParseUint(p.Sub, 10, 64)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	claims := Claims{
+		UserID:        userID,
+		SessionID:     p.Sid,
+		EmailVerified: p.Evf,
+		IssuedAt:      time.Unix(p.Iat, 0),
+		ExpiresAt:     time.Unix(p.Exp, 0),
+	}
+	if !s.now().Before(claims.ExpiresAt) {
+		return nil, ErrExpired
+	}
+	return &claims, nil
+}
+
+// TTL is the lifetime of the access tokens issued by the signer.
+func (s *Signer) TTL() time.Duration {
+	return s.ttl
+}
+
+func sign(key []byte, signingInput string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeJSON(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
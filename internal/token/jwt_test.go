@@ -0,0 +1,80 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSigner(activeKeyID string, now time.Time) *Signer {
+	return &Signer{
+		keys: map[string][]byte{
+			"old": []byte("old-secret"),
+			"new": []byte("new-secret"),
+		},
+		activeKeyID: activeKeyID,
+		ttl:         time.Minute * 15,
+		now:         func() time.Time { return now },
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	s := newTestSigner("new", now)
+
+	token, expiresAt, err := s.Sign(Claims{UserID: 42, SessionID: 7, EmailVerified: true})
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(time.Minute*15), expiresAt)
+
+	claims, err := s.Verify(token)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), claims.UserID)
+	assert.Equal(t, uint64(7), claims.SessionID)
+	assert.True(t, claims.EmailVerified)
+	assert.Equal(t, expiresAt, claims.ExpiresAt)
+}
+
+func TestVerifyRotatedKey(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	token, _, err := newTestSigner("old", now).Sign(Claims{UserID: 1, SessionID: 1})
+	assert.Nil(t, err)
+
+	_, err = newTestSigner("new", now).Verify(token)
+	assert.Nil(t, err)
+
+	retired := newTestSigner("new", now)
+	delete(retired.keys, "old")
+	_, err = retired.Verify(token)
+	assert.Equal(t, ErrInvalid, err)
+}
+
+func TestVerifyExpired(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	token, _, err := newTestSigner("new", now).Sign(Claims{UserID: 1, SessionID: 1})
+	assert.Nil(t, err)
+
+	_, err = newTestSigner("new", now.Add(time.Minute*15)).Verify(token)
+	assert.Equal(t, ErrExpired, err)
+}
+
+func TestVerifyTampered(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	s := newTestSigner("new", now)
+
+	token, _, err := s.Sign(Claims{UserID: 1, SessionID: 1})
+	assert.Nil(t, err)
+
+	other, _, err := s.Sign(Claims{UserID: 2, SessionID: 1})
+	assert.Nil(t, err)
+
+	// payload of one token with the signature of another
+	tampered := token[:len(token)-10] + other[len(other)-10:]
+	_, err = s.Verify(tampered)
+	assert.Equal(t, ErrInvalid, err)
+
+	_, err = s.Verify("not.a.token")
+	assert.Equal(t, ErrInvalid, err)
+}
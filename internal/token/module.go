@@ -0,0 +1,11 @@
+package token
+
+import (
+	"go.uber.org/fx"
+)
+
+var (
+	Module = fx.Provide(
+		NewSigner,
+	)
+)
@@ -0,0 +1,59 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rfcSecret is the SHA1 secret of the RFC 6238 test vectors.
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range cases {
+		got, err := Code(rfcSecret, unix/period)
+		assert.Nil(t, err)
+		assert.Equal(t, want, got, "time %d", unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	step, ok := Validate(rfcSecret, "050471", now)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1111111111/period), step)
+
+	// the previous step is still accepted
+	_, ok = Validate(rfcSecret, "050471", now.Add(time.Second*period))
+	assert.True(t, ok)
+
+	_, ok = Validate(rfcSecret, "050471", now.Add(time.Second*period*2))
+	assert.False(t, ok)
+
+	_, ok = Validate(rfcSecret, "000000", now)
+	assert.False(t, ok)
+
+	_, ok = Validate(rfcSecret, "05047", now)
+	assert.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.Nil(t, err)
+
+	code, err := Code(secret, 1)
+	assert.Nil(t, err)
+	assert.Len(t, code, digits)
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/service"
+	"math"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator"
@@ -19,14 +22,22 @@ import (
 
 	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/config"
 	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/db"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/oidc"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/passpolicy"
+	"github.com/Rogue-Bear-Innovations/bookmarker-back/internal/search"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+// oidcStateCookieName is the cookie holding the state of an OIDC sign in in the browser.
+const oidcStateCookieName = "oidc_state"
+
 type (
 	RegisterReq struct {
 		Email    string `json:"email" validate:"required,email"`
-		Password string `json:"password" validate:"required,min=12"`
+		Password string `json:"password" validate:"required"`
+		// InviteCode is only needed while registration is invite only.
+		InviteCode string `json:"invite_code"`
 	}
 
 	LoginReq struct {
@@ -49,14 +60,49 @@ type (
 	}
 
 	BookmarkReqList struct {
-		Tags []uint64 `json:"tags"`
+		// Tags is the same as TagsAny, which it predates.
+		Tags     []uint64 `json:"tags"`
+		TagsAll  []uint64 `json:"tags_all"`
+		TagsAny  []uint64 `json:"tags_any"`
+		TagsNone []uint64 `json:"tags_none"`
+		Untagged bool     `json:"untagged"`
+		// Q is a search in the language of the search package, like `golang tag:db -site:github.com`.
+		Q     string `json:"q" validate:"max=256"`
+		Limit uint64 `json:"limit" validate:"max=100"`
+		// Cursor is next_cursor of the previous page.
+		Cursor string `json:"cursor"`
+	}
+
+	SearchSyntaxErrorResp struct {
+		Message string `json:"message"`
+		// Position is in characters from 0.
+		Position int `json:"position"`
+	}
+
+	BookmarkListResp struct {
+		Items []BookmarkResp `json:"items"`
+		// NextCursor is omitted on the last page.
+		NextCursor string `json:"next_cursor,omitempty"`
 	}
 
 	BookmarkResp struct {
-		ID          uint64  `json:"id"`
-		Name        *string `json:"name,omitempty"`
-		Link        *string `json:"link,omitempty"`
-		Description *string `json:"description,omitempty"`
+		ID          uint64    `json:"id"`
+		Name        *string   `json:"name,omitempty"`
+		Link        *string   `json:"link,omitempty"`
+		Description *string   `json:"description,omitempty"`
+		Tags        []TagResp `json:"tags"`
+		CreatedAt   time.Time `json:"created_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
+		// Match is only set on search results.
+		Match *BookmarkMatchResp `json:"match,omitempty"`
+	}
+
+	// BookmarkMatchResp tells how well a bookmark matches a search and where. Highlights are HTML
+	// with the matching words between <mark> tags.
+	BookmarkMatchResp struct {
+		Rank                 float32 `json:"rank"`
+		NameHighlight        string  `json:"name_highlight"`
+		DescriptionHighlight string  `json:"description_highlight"`
 	}
 
 	TagReq struct {
@@ -68,153 +114,1411 @@ type (
 		Name string `json:"name"`
 	}
 
-	LoginResp struct {
-		Token string `json:"token"`
+	EmailChangeReq struct {
+		Email    string `json:"email" validate:"required,email"`
+		Password string `json:"password" validate:"required"`
+	}
+
+	EmailChangeConfirmReq struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	PasswordChangeReq struct {
+		CurrentPassword string `json:"current_password" validate:"required"`
+		NewPassword     string `json:"new_password" validate:"required"`
+	}
+
+	AccountDeleteReq struct {
+		Password string `json:"password" validate:"required"`
+	}
+
+	AccountDeleteResp struct {
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	}
+
+	PasswordResetRequestReq struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	PasswordResetReq struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+
+	EmailVerifyReq struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	APIKeyCreateReq struct {
+		Name   string   `json:"name" validate:"required"`
+		Scopes []string `json:"scopes" validate:"required,min=1"`
+	}
+
+	APIKeyResp struct {
+		ID         uint64     `json:"id"`
+		Name       string     `json:"name"`
+		Prefix     string     `json:"prefix"`
+		Scopes     []string   `json:"scopes"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		// Key is only returned once, right after creation.
+		Key string `json:"key,omitempty"`
+	}
+
+	MagicLinkReq struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	MagicLinkConsumeReq struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	InviteCreateReq struct {
+		MaxUses int `json:"max_uses" validate:"min=0,max=1000"`
+		// ExpiresIn is the lifetime of the invite in seconds, INVITE_TTL if left out.
+		ExpiresIn int64 `json:"expires_in" validate:"min=0"`
+	}
+
+	InviteResp struct {
+		ID        uint64    `json:"id"`
+		Prefix    string    `json:"prefix"`
+		MaxUses   int       `json:"max_uses"`
+		Uses      int       `json:"uses"`
+		ExpiresAt time.Time `json:"expires_at"`
+		CreatedAt time.Time `json:"created_at"`
+		// Code is only returned once, right after creation.
+		Code string `json:"code,omitempty"`
+	}
+
+	LoginTwoFactorReq struct {
+		ChallengeToken string `json:"challenge_token" validate:"required"`
+		Code           string `json:"code" validate:"required_without=RecoveryCode"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	TwoFactorConfirmReq struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	TwoFactorDisableReq struct {
+		Code         string `json:"code" validate:"required_without=RecoveryCode"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	TwoFactorEnrollResp struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	TwoFactorConfirmResp struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	TwoFactorChallengeResp struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+	}
+
+	DataExportResp struct {
+		ID        uint64    `json:"id"`
+		Status    string    `json:"status"`
+		CreatedAt time.Time `json:"created_at"`
+		// ExpiresAt is when a finished export is deleted.
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+		// DownloadURL is only set once the export is done, and expires before the export does.
+		DownloadURL          string     `json:"download_url,omitempty"`
+		DownloadURLExpiresAt *time.Time `json:"download_url_expires_at,omitempty"`
+	}
+
+	PasswordRejectedResp struct {
+		Message string              `json:"message"`
+		Reasons []passpolicy.Reason `json:"reasons"`
+	}
+
+	AdminUserListReq struct {
+		Query  string `query:"q"`
+		Limit  uint64 `query:"limit" validate:"max=100"`
+		Offset uint64 `query:"offset"`
+	}
+
+	AdminUserResp struct {
+		ID               uint64     `json:"id"`
+		Email            string     `json:"email"`
+		Role             string     `json:"role"`
+		EmailVerified    bool       `json:"email_verified"`
+		TwoFactorEnabled bool       `json:"two_factor_enabled"`
+		DisabledAt       *time.Time `json:"disabled_at"`
+		CreatedAt        time.Time  `json:"created_at"`
+		BookmarkCount    int64      `json:"bookmark_count"`
+		TagCount         int64      `json:"tag_count"`
+	}
+
+	AdminUserListResp struct {
+		Items []AdminUserResp `json:"items"`
+		Total int64           `json:"total"`
+	}
+
+	AuditListReq struct {
+		Event   string     `query:"event"`
+		Outcome string     `query:"outcome" validate:"omitempty,oneof=success failure"`
+		From    *time.Time `query:"from"`
+		To      *time.Time `query:"to"`
+		// Before is next_before of the previous page.
+		Before uint64 `query:"before"`
+		Limit  uint64 `query:"limit" validate:"max=100"`
+	}
+
+	AdminAuditListReq struct {
+		AuditListReq
+		UserID  uint64 `query:"user_id"`
+		ActorID uint64 `query:"actor_id"`
+		IP      string `query:"ip"`
+	}
+
+	AuditEventResp struct {
+		ID        uint64    `json:"id"`
+		CreatedAt time.Time `json:"created_at"`
+		Event     string    `json:"event"`
+		Outcome   string    `json:"outcome"`
+		UserID    *uint64   `json:"user_id"`
+		ActorID   *uint64   `json:"actor_id"`
+		IP        string    `json:"ip"`
+		UserAgent string    `json:"user_agent"`
+		Details   string    `json:"details"`
+	}
+
+	AuditListResp struct {
+		Items []AuditEventResp `json:"items"`
+		// NextBefore is omitted on the last page.
+		NextBefore *uint64 `json:"next_before,omitempty"`
+	}
+
+	RefreshReq struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+
+	LoginResp struct {
+		Token        string    `json:"token"`
+		ExpiresAt    time.Time `json:"expires_at"`
+		RefreshToken string    `json:"refresh_token"`
+	}
+
+	SessionResp struct {
+		ID         uint64    `json:"id"`
+		UserAgent  string    `json:"user_agent"`
+		IP         string    `json:"ip"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastUsedAt time.Time `json:"last_used_at"`
+		Current    bool      `json:"current"`
+	}
+
+	OIDCExchangeReq struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	HTTPServer struct {
+		cfg            *config.Config
+		db             *gorm.DB
+		generalService *service.General
+		logger         *zap.SugaredLogger
+	}
+)
+
+func NewHTTPServer(lc fx.Lifecycle, cfg *config.Config, db *gorm.DB, general *service.General, logger *zap.SugaredLogger) *HTTPServer {
+	app := fiber.New(fiber.Config{
+		IdleTimeout: time.Second * 30,
+		ProxyHeader: cfg.ProxyHeader,
+		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
+			censoredBodyB := censorBody(ctx.Body())
+
+			logger.Errorw("request failed",
+				"error", err,
+				"path", ctx.Path(),
+				"method", ctx.Method(),
+				"request_body", string(censoredBodyB),
+				"request_headers", censorHeaders(ctx.Request().Header.String()),
+				"request_query", censorQuery(string(ctx.Request().URI().QueryString())),
+				"response_status", ctx.Response().StatusCode(),
+			)
+
+			code := ctx.Response().StatusCode()
+			if code == fiber.StatusOK { // we know that something went wrong here, but they might not set status
+				code = fiber.StatusInternalServerError
+			}
+			ctx.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+			ctx.Status(code)
+
+			// don't send internal error messages
+			if code == fiber.StatusInternalServerError {
+				return ctx.SendString("Internal Server Error")
+			}
+			return ctx.SendString(err.Error())
+		},
+	})
+
+	instance := HTTPServer{
+		cfg:            cfg,
+		db:             db,
+		generalService: general,
+		logger:         logger,
+	}
+
+	// middlewares
+	app.Use(cors.New())        // might add options https://github.com/gofiber/fiber/tree/master/middleware/cors
+	app.Use(fiberLogger.New()) // https://github.com/gofiber/fiber/blob/master/middleware/logger/README.md
+	app.Use(recover.New(recover.Config{
+		EnableStackTrace: true,
+	})) // https://github.com/gofiber/fiber/blob/master/middleware/recover/README.md
+
+	// routes
+	app.Get("/ping", func(c *fiber.Ctx) error { return c.SendString("pong") })
+
+	authG := app.Group("/auth")
+	authG.Post("/register", instance.Register)
+	authG.Post("/login", instance.Login)
+	authG.Post("/login/2fa", instance.LoginTwoFactor)
+	authG.Post("/magic-link", instance.MagicLink)
+	authG.Post("/magic-link/consume", instance.MagicLinkConsume)
+	authG.Post("/refresh", instance.Refresh)
+	authG.Post("/password/reset-request", instance.PasswordResetRequest)
+	authG.Post("/password/reset", instance.PasswordReset)
+	authG.Post("/verify", instance.EmailVerify)
+	authG.Post("/email/confirm", instance.EmailChangeConfirm)
+	authG.Get("/export/download", instance.DataExportDownload)
+	authG.Get("/oidc", instance.OIDCProviders)
+	authG.Post("/oidc/exchange", instance.OIDCExchange)
+	authG.Get("/oidc/:provider", instance.OIDCStart)
+	authG.Get("/oidc/:provider/callback", instance.OIDCCallback)
+
+	internalG := app.Group("")
+
+	internalG.Use(instance.AuthMiddleware)
+
+	authInternalG := internalG.Group("/auth")
+	authInternalG.Use(instance.SessionOnlyMiddleware)
+	authInternalG.Post("/logout", instance.Logout)
+	authInternalG.Get("/sessions", instance.SessionList)
+	authInternalG.Delete("/sessions", instance.SessionDeleteOthers)
+	authInternalG.Delete("/sessions/:id", instance.SessionDelete)
+	authInternalG.Post("/password", instance.PasswordChange)
+	authInternalG.Post("/email", instance.EmailChange)
+	authInternalG.Delete("/account", instance.AccountDelete)
+	authInternalG.Post("/account/cancel-deletion", instance.AccountDeleteCancel)
+	authInternalG.Post("/verify/resend", instance.EmailVerificationResend)
+	authInternalG.Post("/2fa/enroll", instance.TwoFactorEnroll)
+	authInternalG.Post("/2fa/confirm", instance.TwoFactorConfirm)
+	authInternalG.Post("/2fa/disable", instance.TwoFactorDisable)
+	authInternalG.Post("/export", instance.DataExportCreate)
+	authInternalG.Get("/export/:id", instance.DataExportGet)
+	authInternalG.Post("/api-keys", instance.APIKeyCreate)
+	authInternalG.Get("/api-keys", instance.APIKeyList)
+	authInternalG.Delete("/api-keys/:id", instance.APIKeyDelete)
+	authInternalG.Get("/audit", instance.AuditList)
+	authInternalG.Post("/invites", instance.InviteCreate)
+	authInternalG.Get("/invites", instance.InviteList)
+	authInternalG.Delete("/invites/:id", instance.InviteDelete)
+
+	adminG := internalG.Group("/admin")
+	adminG.Use(instance.SessionOnlyMiddleware, instance.AdminMiddleware)
+	adminG.Get("/users", instance.AdminUserList)
+	adminG.Get("/users/:id", instance.AdminUserGet)
+	adminG.Post("/users/:id/disable", instance.AdminUserDisable)
+	adminG.Post("/users/:id/enable", instance.AdminUserEnable)
+	adminG.Post("/users/:id/logout", instance.AdminUserLogout)
+	adminG.Post("/users/:id/password-reset", instance.AdminUserPasswordReset)
+	adminG.Get("/audit", instance.AdminAuditList)
+
+	bookmarkG := internalG.Group("/bookmark")
+	bookmarkRead := instance.ScopeMiddleware(service.ScopeBookmarksRead)
+	bookmarkWrite := instance.ScopeMiddleware(service.ScopeBookmarksWrite)
+	bookmarkG.Post("/list", bookmarkRead, instance.BookmarkGet)
+	bookmarkG.Get("/:id", bookmarkRead, instance.BookmarkGetOne)
+	bookmarkG.Post("", bookmarkWrite, instance.VerifiedMiddleware, instance.BookmarkCreate)
+	bookmarkG.Patch("/:id", bookmarkWrite, instance.VerifiedMiddleware, instance.BookmarkUpdate)
+	bookmarkG.Delete("/:id", bookmarkWrite, instance.VerifiedMiddleware, instance.BookmarkDelete)
+
+	tagG := internalG.Group("/tag")
+	tagRead := instance.ScopeMiddleware(service.ScopeTagsRead)
+	tagWrite := instance.ScopeMiddleware(service.ScopeTagsWrite)
+	tagG.Get("", tagRead, instance.TagGet)
+	tagG.Post("", tagWrite, instance.VerifiedMiddleware, instance.TagCreate)
+	tagG.Patch("/:id", tagWrite, instance.VerifiedMiddleware, instance.TagUpdate)
+	tagG.Delete("/:id", tagWrite, instance.VerifiedMiddleware, instance.TagDelete)
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			go func() {
+				listen := cfg.Host + ":" + cfg.Port
+				if err := app.Listen(listen); err != nil {
+					logger.Fatalw("server stopped", "error", err)
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			logger.Info("Stopping HTTP server.")
+			return app.Shutdown()
+		},
+	})
+
+	return &instance
+}
+
+// AuthMiddleware accepts either an access token or an API key in the x-token header.
+// Requests made with an API key carry its scopes in the context, see ScopeMiddleware.
+func (s *HTTPServer) AuthMiddleware(c *fiber.Ctx) error {
+	token := c.Get("x-token")
+	if token == "" {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	if service.IsAPIKey(token) {
+		key, err := s.generalService.APIKeyAuthenticate(token)
+		if err != nil {
+			if errors.Is(err, service.ErrAPIKeyInvalid) {
+				return c.SendStatus(fiber.StatusUnauthorized)
+			}
+			if errors.Is(err, service.ErrUserDisabled) {
+				return c.Status(fiber.StatusForbidden).SendString(err.Error())
+			}
+			return errors.Wrap(err, "service authenticate api key")
+		}
+
+		c.Locals("user", &db.User{
+			GormForkedModel: db.GormForkedModel{ID: key.UserID},
+		})
+		c.Locals("scopes", service.APIKeyScopes(key))
+		return c.Next()
+	}
+
+	claims, err := s.generalService.Authenticate(token)
+	if err != nil {
+		if errors.Is(err, service.ErrUserDisabled) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	c.Locals("user", &db.User{
+		GormForkedModel: db.GormForkedModel{ID: claims.UserID},
+	})
+	c.Locals("session", &db.Session{
+		GormForkedModel: db.GormForkedModel{ID: claims.SessionID},
+		UserID:          claims.UserID,
+	})
+	c.Locals("email_verified", claims.EmailVerified)
+	return c.Next()
+}
+
+// SessionOnlyMiddleware keeps API keys away from account management.
+func (s *HTTPServer) SessionOnlyMiddleware(c *fiber.Ctx) error {
+	if c.Locals("session") == nil {
+		return c.Status(fiber.StatusForbidden).SendString("API keys cannot be used here")
+	}
+	return c.Next()
+}
+
+// ScopeMiddleware rejects requests made with an API key lacking the scope. Sessions have every scope.
+func (s *HTTPServer) ScopeMiddleware(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		scopes, ok := c.Locals("scopes").([]string)
+		if !ok {
+			return c.Next()
+		}
+		for i := range scopes {
+			if scopes[i] == scope {
+				return c.Next()
+			}
+		}
+		return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("API key lacks the '%s' scope", scope))
+	}
+}
+
+// AdminMiddleware only lets admins through.
+func (s *HTTPServer) AdminMiddleware(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	if err := s.generalService.AdminCheck(user.ID); err != nil {
+		if errors.Is(err, service.ErrNotAdmin) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service check admin")
+	}
+	return c.Next()
+}
+
+// VerifiedMiddleware only lets through users allowed to change data, which depends on UNVERIFIED_ACCESS.
+// The database is asked only when the access token says the email is not verified,
+// since it could have been verified after the token was issued.
+func (s *HTTPServer) VerifiedMiddleware(c *fiber.Ctx) error {
+	if verified, _ := c.Locals("email_verified").(bool); verified {
+		return c.Next()
+	}
+
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	if err := s.generalService.WriteAllowed(user.ID); err != nil {
+		if errors.Is(err, service.ErrEmailNotVerified) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service check write allowed")
+	}
+	return c.Next()
+}
+
+func (s *HTTPServer) Register(c *fiber.Ctx) error {
+	req := RegisterReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	pair, err := s.generalService.Register(req.Email, req.Password, req.InviteCode, GetClientInfo(c))
+	if err != nil {
+		var rejected *passpolicy.Error
+		if errors.As(err, &rejected) {
+			return SendPasswordRejected(c, rejected)
+		}
+		if errors.Is(err, service.ErrRegistrationClosed) ||
+			errors.Is(err, service.ErrInviteRequired) ||
+			errors.Is(err, service.ErrInviteInvalid) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service register")
+	}
+	return c.JSON(NewLoginResp(pair))
+}
+
+func (s *HTTPServer) Login(c *fiber.Ctx) error {
+	req := LoginReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	result, err := s.generalService.Login(req.Email, req.Password, GetClientInfo(c))
+	if err != nil {
+		var locked *service.LoginLockedError
+		if errors.As(err, &locked) {
+			return SendLoginLocked(c, locked)
+		}
+		if errors.Is(err, service.ErrLoginUserNotFound) ||
+			errors.Is(err, service.ErrLoginPasswordDoesNotMatch) {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		if errors.Is(err, service.ErrUserDisabled) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service login")
+	}
+
+	return SendLoginResult(c, result)
+}
+
+func (s *HTTPServer) MagicLink(c *fiber.Ctx) error {
+	req := MagicLinkReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	if err := s.generalService.MagicLinkRequest(req.Email); err != nil {
+		if errors.Is(err, service.ErrMagicLinkThrottled) {
+			return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service request magic link")
+	}
+
+	// the same answer whether the email has an account or not
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) MagicLinkConsume(c *fiber.Ctx) error {
+	req := MagicLinkConsumeReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	result, err := s.generalService.MagicLinkLogin(req.Token, GetClientInfo(c))
+	if err != nil {
+		if errors.Is(err, service.ErrOneTimeTokenInvalid) {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		if errors.Is(err, service.ErrUserDisabled) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service magic link login")
+	}
+
+	return SendLoginResult(c, result)
+}
+
+func (s *HTTPServer) LoginTwoFactor(c *fiber.Ctx) error {
+	req := LoginTwoFactorReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	pair, err := s.generalService.LoginTwoFactor(req.ChallengeToken, req.Code, req.RecoveryCode, GetClientInfo(c))
+	if err != nil {
+		var locked *service.LoginLockedError
+		if errors.As(err, &locked) {
+			return SendLoginLocked(c, locked)
+		}
+		if errors.Is(err, service.ErrOneTimeTokenInvalid) ||
+			errors.Is(err, service.ErrTwoFactorCodeInvalid) {
+			return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
+		if errors.Is(err, service.ErrUserDisabled) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service login two factor")
+	}
+
+	return c.JSON(NewLoginResp(pair))
+}
+
+func (s *HTTPServer) TwoFactorEnroll(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	secret, uri, err := s.generalService.TwoFactorEnroll(user.ID)
+	if err != nil {
+		if errors.Is(err, service.ErrTwoFactorEnabled) {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service enroll two factor")
+	}
+
+	return c.JSON(TwoFactorEnrollResp{
+		Secret: secret,
+		URI:    uri,
+	})
+}
+
+func (s *HTTPServer) TwoFactorConfirm(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	req := TwoFactorConfirmReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	codes, err := s.generalService.TwoFactorConfirm(user.ID, req.Code)
+	s.audit(c, service.AuditTwoFactorEnable, user.ID, err)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrTwoFactorEnabled):
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		case errors.Is(err, service.ErrTwoFactorNotEnrolled),
+			errors.Is(err, service.ErrTwoFactorCodeInvalid):
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service confirm two factor")
+	}
+
+	return c.JSON(TwoFactorConfirmResp{RecoveryCodes: codes})
+}
+
+func (s *HTTPServer) TwoFactorDisable(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	req := TwoFactorDisableReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	err = s.generalService.TwoFactorDisable(user.ID, req.Code, req.RecoveryCode, GetClientInfo(c))
+	s.audit(c, service.AuditTwoFactorDisable, user.ID, err)
+	if err != nil {
+		var locked *service.LoginLockedError
+		if errors.As(err, &locked) {
+			return SendLoginLocked(c, locked)
+		}
+		switch {
+		case errors.Is(err, service.ErrTwoFactorNotEnabled):
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		case errors.Is(err, service.ErrTwoFactorCodeInvalid):
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service disable two factor")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) Refresh(c *fiber.Ctx) error {
+	req := RefreshReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	pair, err := s.generalService.Refresh(req.RefreshToken, GetClientInfo(c))
+	if err != nil {
+		if errors.Is(err, service.ErrRefreshTokenInvalid) ||
+			errors.Is(err, service.ErrRefreshTokenReused) {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		if errors.Is(err, service.ErrUserDisabled) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service refresh")
+	}
+
+	return c.JSON(NewLoginResp(pair))
+}
+
+func (s *HTTPServer) Logout(c *fiber.Ctx) error {
+	session, err := GetSessionFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	err = s.generalService.SessionDelete(session.UserID, session.ID)
+	s.audit(c, service.AuditLogout, session.UserID, err)
+	if err != nil && !errors.Is(err, service.ErrSessionNotFound) {
+		return errors.Wrap(err, "service delete session")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) SessionList(c *fiber.Ctx) error {
+	current, err := GetSessionFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s.generalService.SessionList(current.UserID)
+	if err != nil {
+		return errors.Wrap(err, "service list sessions")
+	}
+
+	resp := make([]SessionResp, len(sessions))
+	for i := range sessions {
+		resp[i] = SessionResp{
+			ID:         sessions[i].ID,
+			UserAgent:  sessions[i].UserAgent,
+			IP:         sessions[i].IP,
+			CreatedAt:  sessions[i].CreatedAt,
+			LastUsedAt: sessions[i].LastUsedAt,
+			Current:    sessions[i].ID == current.ID,
+		}
+	}
+	return c.JSON(resp)
+}
+
+func (s *HTTPServer) SessionDelete(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
+		return err
+	}
+	session, err := GetSessionFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	err = s.generalService.SessionDelete(session.UserID, id)
+	s.audit(c, service.AuditSessionRevoke, session.UserID, err)
+	if err != nil {
+		if errors.Is(err, service.ErrSessionNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return errors.Wrap(err, "service delete session")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) SessionDeleteOthers(c *fiber.Ctx) error {
+	session, err := GetSessionFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	err = s.generalService.SessionDeleteOthers(session.UserID, session.ID)
+	s.audit(c, service.AuditSessionRevokeOthers, session.UserID, err)
+	if err != nil {
+		return errors.Wrap(err, "service delete other sessions")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) OIDCProviders(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"providers": s.generalService.OIDCProviders(),
+	})
+}
+
+// OIDCStart sends the browser to the provider to sign in.
+func (s *HTTPServer) OIDCStart(c *fiber.Ctx) error {
+	provider, err := GetParam(c, "provider")
+	if err != nil {
+		return err
+	}
+
+	authURL, state, err := s.generalService.OIDCStart(c.Context(), provider)
+	if err != nil {
+		if errors.Is(err, oidc.ErrProviderNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return errors.Wrap(err, "service start oidc")
+	}
+
+	// Lax so that the cookie comes along when the provider sends the browser back
+	c.Cookie(s.oidcStateCookie(state, time.Time{}))
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// OIDCCallback is where the provider sends the browser back to. The browser is then sent on
+// to the client app with either a login token to exchange or an error code.
+func (s *HTTPServer) OIDCCallback(c *fiber.Ctx) error {
+	provider, err := GetParam(c, "provider")
+	if err != nil {
+		return err
+	}
+
+	if providerErr := c.Query("error"); providerErr != "" {
+		return s.oidcRedirect(c, url.Values{"error": {providerErr}})
+	}
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("state and code are required")
+	}
+
+	browserState := c.Cookies(oidcStateCookieName)
+	c.Cookie(s.oidcStateCookie("", time.Unix(0, 0)))
+
+	loginToken, err := s.generalService.OIDCCallback(c.Context(), provider, state, browserState, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrProviderNotFound):
+			return c.SendStatus(fiber.StatusNotFound)
+		case errors.Is(err, service.ErrOIDCStateInvalid):
+			return s.oidcRedirect(c, url.Values{"error": {"state_invalid"}})
+		case errors.Is(err, service.ErrOIDCExchangeFailed):
+			return s.oidcRedirect(c, url.Values{"error": {"exchange_failed"}})
+		case errors.Is(err, service.ErrOIDCEmailNotVerified):
+			return s.oidcRedirect(c, url.Values{"error": {"email_not_verified"}})
+		case errors.Is(err, service.ErrOIDCAccountNotConfirmed):
+			return s.oidcRedirect(c, url.Values{"error": {"account_not_confirmed"}})
+		case errors.Is(err, service.ErrRegistrationClosed):
+			return s.oidcRedirect(c, url.Values{"error": {"registration_closed"}})
+		}
+		return errors.Wrap(err, "service oidc callback")
+	}
+
+	return s.oidcRedirect(c, url.Values{"token": {loginToken}})
+}
+
+// oidcStateCookie ties a sign in to the browser that started it. A zero expiry makes it last until
+// the browser is closed, a past one deletes it.
+func (s *HTTPServer) oidcStateCookie(state string, expires time.Time) *fiber.Cookie {
+	return &fiber.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/auth/oidc",
+		Expires:  expires,
+		Secure:   strings.HasPrefix(s.cfg.APIURL, "https://"),
+		HTTPOnly: true,
+		SameSite: "Lax",
+	}
+}
+
+func (s *HTTPServer) oidcRedirect(c *fiber.Ctx, query url.Values) error {
+	return c.Redirect(s.cfg.PublicURL+"/oidc/callback?"+query.Encode(), fiber.StatusFound)
+}
+
+func (s *HTTPServer) OIDCExchange(c *fiber.Ctx) error {
+	req := OIDCExchangeReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	result, err := s.generalService.OIDCExchange(req.Token, GetClientInfo(c))
+	if err != nil {
+		if errors.Is(err, service.ErrOneTimeTokenInvalid) {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		if errors.Is(err, service.ErrUserDisabled) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service oidc exchange")
+	}
+
+	return SendLoginResult(c, result)
+}
+
+func (s *HTTPServer) PasswordChange(c *fiber.Ctx) error {
+	session, err := GetSessionFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	req := PasswordChangeReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	err = s.generalService.PasswordChange(session.UserID, session.ID, req.CurrentPassword, req.NewPassword, GetClientInfo(c))
+	s.audit(c, service.AuditPasswordChange, session.UserID, err)
+	if err != nil {
+		var locked *service.LoginLockedError
+		if errors.As(err, &locked) {
+			return SendLoginLocked(c, locked)
+		}
+		var rejected *passpolicy.Error
+		if errors.As(err, &rejected) {
+			return SendPasswordRejected(c, rejected)
+		}
+		if errors.Is(err, service.ErrPasswordDoesNotMatch) || errors.Is(err, service.ErrPasswordNotSet) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service change password")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) AccountDelete(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	req := AccountDeleteReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	at, err := s.generalService.AccountDelete(user.ID, req.Password)
+	s.audit(c, service.AuditAccountDelete, user.ID, err)
+	if err != nil {
+		if errors.Is(err, service.ErrPasswordDoesNotMatch) || errors.Is(err, service.ErrPasswordNotSet) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service delete account")
+	}
+
+	if at == nil {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(AccountDeleteResp{DeletionScheduledAt: *at})
+}
+
+func (s *HTTPServer) AccountDeleteCancel(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	err = s.generalService.AccountDeleteCancel(user.ID)
+	s.audit(c, service.AuditAccountDeleteCancel, user.ID, err)
+	if err != nil {
+		if errors.Is(err, service.ErrAccountDeletionNotScheduled) {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service cancel account deletion")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) PasswordResetRequest(c *fiber.Ctx) error {
+	req := PasswordResetRequestReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	if err := s.generalService.PasswordResetRequest(req.Email); err != nil {
+		if errors.Is(err, service.ErrPasswordResetThrottled) {
+			return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service request password reset")
+	}
+
+	// the same answer whether the email has an account or not
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) PasswordReset(c *fiber.Ctx) error {
+	req := PasswordResetReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	err := s.generalService.PasswordReset(req.Token, req.Password, GetClientInfo(c))
+	if err != nil {
+		var rejected *passpolicy.Error
+		if errors.As(err, &rejected) {
+			return SendPasswordRejected(c, rejected)
+		}
+		if errors.Is(err, service.ErrOneTimeTokenInvalid) {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service reset password")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) EmailVerify(c *fiber.Ctx) error {
+	req := EmailVerifyReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	err := s.generalService.EmailVerify(req.Token)
+	if err != nil {
+		if errors.Is(err, service.ErrOneTimeTokenInvalid) {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service verify email")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) EmailChange(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	req := EmailChangeReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	err = s.generalService.EmailChangeRequest(user.ID, req.Password, req.Email)
+	s.audit(c, service.AuditEmailChangeRequest, user.ID, err)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrPasswordDoesNotMatch), errors.Is(err, service.ErrPasswordNotSet):
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		case errors.Is(err, service.ErrEmailUnchanged):
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		case errors.Is(err, service.ErrEmailTaken):
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service request email change")
+	}
+
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+func (s *HTTPServer) EmailChangeConfirm(c *fiber.Ctx) error {
+	req := EmailChangeConfirmReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	err := s.generalService.EmailChangeConfirm(req.Token, GetClientInfo(c))
+	if err != nil {
+		if errors.Is(err, service.ErrOneTimeTokenInvalid) {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if errors.Is(err, service.ErrEmailTaken) {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service confirm email change")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) EmailVerificationResend(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	err = s.generalService.EmailVerificationResend(user.ID)
+	if err != nil {
+		if errors.Is(err, service.ErrEmailAlreadyVerified) {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		if errors.Is(err, service.ErrEmailVerificationThrottled) {
+			return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service resend verification")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) APIKeyCreate(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	req := APIKeyCreateReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	model, key, err := s.generalService.APIKeyCreate(user.ID, req.Name, req.Scopes)
+	s.audit(c, service.AuditAPIKeyCreate, user.ID, err)
+	if err != nil {
+		if errors.Is(err, service.ErrAPIKeyScopeUnknown) {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service create api key")
+	}
+
+	resp := NewAPIKeyResp(model)
+	resp.Key = key
+	return c.JSON(resp)
+}
+
+func (s *HTTPServer) APIKeyList(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.generalService.APIKeyList(user.ID)
+	if err != nil {
+		return errors.Wrap(err, "service list api keys")
+	}
+
+	resp := make([]APIKeyResp, len(keys))
+	for i := range keys {
+		resp[i] = NewAPIKeyResp(&keys[i])
+	}
+	return c.JSON(resp)
+}
+
+func (s *HTTPServer) APIKeyDelete(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	err = s.generalService.APIKeyDelete(user.ID, id)
+	s.audit(c, service.AuditAPIKeyDelete, user.ID, err)
+	if err != nil {
+		if errors.Is(err, service.ErrAPIKeyNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return errors.Wrap(err, "service delete api key")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) InviteCreate(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	req := InviteCreateReq{}
+	if err := BindAndValidate(c, &req); err != nil {
+		return err
+	}
+
+	model, code, err := s.generalService.InviteCreate(user.ID, req.MaxUses, time.Duration(req.ExpiresIn)*time.Second)
+	s.audit(c, service.AuditInviteCreate, user.ID, err)
+	if err != nil {
+		if errors.Is(err, service.ErrEmailNotVerified) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		if errors.Is(err, service.ErrInviteTooLarge) {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service create invite")
+	}
+
+	resp := NewInviteResp(model)
+	resp.Code = code
+	return c.JSON(resp)
+}
+
+func (s *HTTPServer) InviteList(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	invites, err := s.generalService.InviteList(user.ID)
+	if err != nil {
+		return errors.Wrap(err, "service list invites")
+	}
+
+	resp := make([]InviteResp, len(invites))
+	for i := range invites {
+		resp[i] = NewInviteResp(&invites[i])
+	}
+	return c.JSON(resp)
+}
+
+func (s *HTTPServer) InviteDelete(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	err = s.generalService.InviteDelete(user.ID, id)
+	s.audit(c, service.AuditInviteDelete, user.ID, err)
+	if err != nil {
+		if errors.Is(err, service.ErrInviteNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return errors.Wrap(err, "service delete invite")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (s *HTTPServer) DataExportCreate(c *fiber.Ctx) error {
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	export, err := s.generalService.DataExportCreate(user.ID)
+	if err != nil {
+		return errors.Wrap(err, "service create data export")
+	}
+
+	if export.Status == service.DataExportDone {
+		return c.JSON(s.newDataExportResp(export))
+	}
+	return c.Status(fiber.StatusAccepted).JSON(s.newDataExportResp(export))
+}
+
+func (s *HTTPServer) DataExportGet(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	export, err := s.generalService.DataExportGet(user.ID, id)
+	if err != nil {
+		if errors.Is(err, service.ErrDataExportNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return errors.Wrap(err, "service get data export")
+	}
+
+	return c.JSON(s.newDataExportResp(export))
+}
+
+func (s *HTTPServer) DataExportDownload(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Query("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid query param 'id'")
+	}
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid query param 'expires'")
+	}
+
+	archive, err := s.generalService.DataExportDownload(id, expires, c.Query("signature"))
+	if err != nil {
+		if errors.Is(err, service.ErrDataExportLinkInvalid) {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service download data export")
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="bookmarker-export.zip"`)
+	return c.Send(archive)
+}
+
+func (s *HTTPServer) AdminUserList(c *fiber.Ctx) error {
+	req := AdminUserListReq{}
+	if err := BindAndValidateQuery(c, &req); err != nil {
+		return err
 	}
-
-	HTTPServer struct {
-		db             *gorm.DB
-		generalService *service.General
-		logger         *zap.SugaredLogger
+	if req.Limit == 0 {
+		req.Limit = 50
 	}
-)
 
-func NewHTTPServer(lc fx.Lifecycle, cfg *config.Config, db *gorm.DB, general *service.General, logger *zap.SugaredLogger) *HTTPServer {
-	app := fiber.New(fiber.Config{
-		IdleTimeout: time.Second * 30,
-		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
-			censoredBodyB := censorBody(ctx.Body())
+	users, total, err := s.generalService.AdminUserList(req.Query, req.Limit, req.Offset)
+	if err != nil {
+		return errors.Wrap(err, "service list users")
+	}
 
-			logger.Errorw("request failed",
-				"error", err,
-				"path", ctx.Path(),
-				"method", ctx.Method(),
-				"request_body", string(censoredBodyB),
-				"request_headers", ctx.Request().Header.String(),
-				"request_query", string(ctx.Request().URI().QueryString()),
-				"response_status", ctx.Response().StatusCode(),
-			)
+	resp := AdminUserListResp{
+		Items: make([]AdminUserResp, len(users)),
+		Total: total,
+	}
+	for i := range users {
+		resp.Items[i] = NewAdminUserResp(&users[i])
+	}
+	return c.JSON(resp)
+}
 
-			code := ctx.Response().StatusCode()
-			if code == fiber.StatusOK { // we know that something went wrong here, but they might not set status
-				code = fiber.StatusInternalServerError
-			}
-			ctx.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
-			ctx.Status(code)
+// AuditList shows the user the security events of their own account.
+func (s *HTTPServer) AuditList(c *fiber.Ctx) error {
+	req := AuditListReq{}
+	if err := BindAndValidateQuery(c, &req); err != nil {
+		return err
+	}
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
 
-			// don't send internal error messages
-			if code == fiber.StatusInternalServerError {
-				return ctx.SendString("Internal Server Error")
-			}
-			return ctx.SendString(err.Error())
-		},
-	})
+	filter := req.filter()
+	filter.UserID = user.ID
+	return s.sendAuditList(c, filter)
+}
 
-	instance := HTTPServer{
-		db:             db,
-		generalService: general,
-		logger:         logger,
+func (s *HTTPServer) AdminAuditList(c *fiber.Ctx) error {
+	req := AdminAuditListReq{}
+	if err := BindAndValidateQuery(c, &req); err != nil {
+		return err
 	}
 
-	// middlewares
-	app.Use(cors.New())        // might add options https://github.com/gofiber/fiber/tree/master/middleware/cors
-	app.Use(fiberLogger.New()) // https://github.com/gofiber/fiber/blob/master/middleware/logger/README.md
-	app.Use(recover.New(recover.Config{
-		EnableStackTrace: true,
-	})) // https://github.com/gofiber/fiber/blob/master/middleware/recover/README.md
+	filter := req.filter()
+	filter.UserID = req.UserID
+	filter.ActorID = req.ActorID
+	filter.IP = req.IP
+	return s.sendAuditList(c, filter)
+}
 
-	// routes
-	app.Get("/ping", func(c *fiber.Ctx) error { return c.SendString("pong") })
+func (s *HTTPServer) sendAuditList(c *fiber.Ctx, filter service.AuditFilter) error {
+	events, err := s.generalService.AuditList(filter)
+	if err != nil {
+		return errors.Wrap(err, "service list audit events")
+	}
 
-	authG := app.Group("/auth")
-	authG.Post("/register", instance.Register)
-	authG.Post("/login", instance.Login)
+	resp := AuditListResp{Items: make([]AuditEventResp, len(events))}
+	for i := range events {
+		resp.Items[i] = NewAuditEventResp(&events[i])
+	}
+	if uint64(len(events)) == filter.Limit {
+		resp.NextBefore = &events[len(events)-1].ID
+	}
+	return c.JSON(resp)
+}
 
-	internalG := app.Group("")
+func (s *HTTPServer) AdminUserGet(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
+		return err
+	}
 
-	internalG.Use(instance.AuthMiddleware)
+	user, err := s.generalService.AdminUserGet(id)
+	if err != nil {
+		if errors.Is(err, service.ErrUserNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return errors.Wrap(err, "service get user")
+	}
 
-	bookmarkG := internalG.Group("/bookmark")
-	bookmarkG.Post("/list", instance.BookmarkGet)
-	bookmarkG.Post("", instance.BookmarkCreate)
-	bookmarkG.Patch("/:id", instance.BookmarkUpdate)
-	bookmarkG.Delete("/:id", instance.BookmarkDelete)
+	return c.JSON(NewAdminUserResp(user))
+}
 
-	tagG := internalG.Group("/tag")
-	tagG.Get("", instance.TagGet)
-	tagG.Post("", instance.TagCreate)
-	tagG.Patch("/:id", instance.TagUpdate)
-	tagG.Delete("/:id", instance.TagDelete)
+func (s *HTTPServer) AdminUserDisable(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
+		return err
+	}
+	admin, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
 
-	lc.Append(fx.Hook{
-		OnStart: func(ctx context.Context) error {
-			go func() {
-				listen := cfg.Host + ":" + cfg.Port
-				if err := app.Listen(listen); err != nil {
-					logger.Fatalw("server stopped", "error", err)
-				}
-			}()
-			return nil
-		},
-		OnStop: func(ctx context.Context) error {
-			logger.Info("Stopping HTTP server.")
-			return app.Shutdown()
-		},
-	})
+	err = s.generalService.AdminUserDisable(admin.ID, id)
+	s.audit(c, service.AuditAdminUserDisable, id, err)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrUserNotFound):
+			return c.SendStatus(fiber.StatusNotFound)
+		case errors.Is(err, service.ErrAdminSelfAction):
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service disable user")
+	}
 
-	return &instance
+	return c.SendStatus(fiber.StatusNoContent)
 }
 
-func (s *HTTPServer) AuthMiddleware(c *fiber.Ctx) error {
-	token := c.Get("x-token")
-	if token == "" {
-		return c.SendStatus(fiber.StatusUnauthorized)
+func (s *HTTPServer) AdminUserEnable(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
+		return err
 	}
 
-	user := db.User{}
-	res := s.db.Where("token = ?", token).First(&user)
-	if res.Error != nil {
-		return c.SendStatus(fiber.StatusUnauthorized)
+	err = s.generalService.AdminUserEnable(id)
+	s.audit(c, service.AuditAdminUserEnable, id, err)
+	if err != nil {
+		if errors.Is(err, service.ErrUserNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return errors.Wrap(err, "service enable user")
 	}
 
-	c.Locals("user", &user)
-	return c.Next()
+	return c.SendStatus(fiber.StatusNoContent)
 }
 
-func (s *HTTPServer) Register(c *fiber.Ctx) error {
-	req := RegisterReq{}
-	if err := BindAndValidate(c, &req); err != nil {
+func (s *HTTPServer) AdminUserLogout(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
 		return err
 	}
 
-	token, err := s.generalService.Register(req.Email, req.Password)
+	err = s.generalService.AdminUserLogout(id)
+	s.audit(c, service.AuditAdminUserLogout, id, err)
 	if err != nil {
-		return errors.Wrap(err, "service register")
-	}
-	resp := struct {
-		Token string `json:"token"`
-	}{
-		Token: token,
+		if errors.Is(err, service.ErrUserNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return errors.Wrap(err, "service log user out")
 	}
-	return c.JSON(&resp)
+
+	return c.SendStatus(fiber.StatusNoContent)
 }
 
-func (s *HTTPServer) Login(c *fiber.Ctx) error {
-	req := LoginReq{}
-	if err := BindAndValidate(c, &req); err != nil {
+func (s *HTTPServer) AdminUserPasswordReset(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
 		return err
 	}
 
-	token, err := s.generalService.Login(req.Email, req.Password)
+	err = s.generalService.AdminUserPasswordReset(id)
+	s.audit(c, service.AuditAdminUserPasswordReset, id, err)
 	if err != nil {
-		if errors.Is(err, service.ErrLoginUserNotFound) ||
-			errors.Is(err, service.ErrLoginPasswordDoesNotMatch) {
-			return c.SendStatus(fiber.StatusUnauthorized)
+		if errors.Is(err, service.ErrUserNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
 		}
-		return errors.Wrap(err, "service login")
+		if errors.Is(err, service.ErrPasswordResetThrottled) {
+			return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+		return errors.Wrap(err, "service reset user password")
 	}
 
-	return c.JSON(&LoginResp{Token: token})
+	return c.SendStatus(fiber.StatusNoContent)
 }
 
 func (s *HTTPServer) BookmarkGet(c *fiber.Ctx) error {
@@ -228,23 +1532,71 @@ func (s *HTTPServer) BookmarkGet(c *fiber.Ctx) error {
 		return err
 	}
 
-	bookmarks, err := s.generalService.BookmarkGet(user, req.Tags)
+	if req.Limit == 0 {
+		req.Limit = 50
+	}
+
+	bookmarks, next, err := s.generalService.BookmarkGet(user, service.BookmarkFilter{
+		TagsAll:  req.TagsAll,
+		TagsAny:  append(req.TagsAny, req.Tags...),
+		TagsNone: req.TagsNone,
+		Untagged: req.Untagged,
+		Query:    req.Q,
+		Limit:    req.Limit,
+		Cursor:   req.Cursor,
+	})
 	if err != nil {
+		if errors.Is(err, service.ErrBookmarkCursorInvalid) {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		var syntaxErr *search.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return c.Status(fiber.StatusBadRequest).JSON(SearchSyntaxErrorResp{
+				Message:  syntaxErr.Msg,
+				Position: syntaxErr.Pos,
+			})
+		}
 		return errors.Wrap(err, "general get bookmarks")
 	}
 
-	resp := make([]BookmarkResp, len(bookmarks))
+	resp := BookmarkListResp{
+		Items:      make([]BookmarkResp, len(bookmarks)),
+		NextCursor: next,
+	}
 	for i := range bookmarks {
-		resp[i] = BookmarkResp{
-			ID:          bookmarks[i].ID,
-			Name:        bookmarks[i].Name,
-			Link:        bookmarks[i].Link,
-			Description: bookmarks[i].Description,
+		resp.Items[i] = NewBookmarkResp(&bookmarks[i].Bookmark)
+		if bookmarks[i].Searched {
+			resp.Items[i].Match = &BookmarkMatchResp{
+				Rank:                 bookmarks[i].Rank,
+				NameHighlight:        bookmarks[i].NameHighlight,
+				DescriptionHighlight: bookmarks[i].DescriptionHighlight,
+			}
 		}
 	}
 	return c.JSON(resp)
 }
 
+func (s *HTTPServer) BookmarkGetOne(c *fiber.Ctx) error {
+	id, err := GetAndParseParam(c, "id")
+	if err != nil {
+		return err
+	}
+	user, err := GetUserFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	bookmark, err := s.generalService.BookmarkGetOne(user, id)
+	if err != nil {
+		if errors.Is(err, service.ErrBookmarkNotFound) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return errors.Wrap(err, "service get bookmark")
+	}
+
+	return c.JSON(NewBookmarkResp(bookmark))
+}
+
 func (s *HTTPServer) BookmarkCreate(c *fiber.Ctx) error {
 	user, err := GetUserFromContext(c)
 	if err != nil {
@@ -268,12 +1620,7 @@ func (s *HTTPServer) BookmarkCreate(c *fiber.Ctx) error {
 		return errors.Wrap(err, "service create")
 	}
 
-	return c.JSON(BookmarkResp{
-		ID:          bookmark.ID,
-		Name:        bookmark.Name,
-		Link:        bookmark.Link,
-		Description: bookmark.Description,
-	})
+	return c.JSON(NewBookmarkResp(bookmark))
 }
 
 func (s *HTTPServer) BookmarkUpdate(c *fiber.Ctx) error {
@@ -296,12 +1643,7 @@ func (s *HTTPServer) BookmarkUpdate(c *fiber.Ctx) error {
 		return errors.Wrap(err, "service update")
 	}
 
-	return c.JSON(BookmarkResp{
-		ID:          model.ID,
-		Name:        model.Name,
-		Link:        model.Link,
-		Description: model.Description,
-	})
+	return c.JSON(NewBookmarkResp(model))
 }
 
 func (s *HTTPServer) BookmarkDelete(c *fiber.Ctx) error {
@@ -459,6 +1801,28 @@ func BindAndValidate(c *fiber.Ctx, v interface{}) error {
 	return nil
 }
 
+// BindAndValidateQuery is BindAndValidate for query parameters.
+func BindAndValidateQuery(c *fiber.Ctx, v interface{}) error {
+	if err := c.QueryParser(v); err != nil {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"message": err.Error(),
+		})
+		return errors.Wrap(err, "parse query")
+	}
+
+	errs := ValidateStruct(v)
+	if len(errs) > 0 {
+		c.Status(fiber.StatusBadRequest).JSON(errs)
+		errStr := ""
+		for i := range errs {
+			errStr += errs[i].String() + "; "
+		}
+		return errors.New(fmt.Sprintf("validation error: %s", errStr))
+	}
+
+	return nil
+}
+
 func GetUserFromContext(c *fiber.Ctx) (*db.User, error) {
 	userRaw := c.Locals("user")
 	if userRaw == nil {
@@ -471,6 +1835,173 @@ func GetUserFromContext(c *fiber.Ctx) (*db.User, error) {
 	return user, nil
 }
 
+func NewAPIKeyResp(key *db.APIKey) APIKeyResp {
+	return APIKeyResp{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.TokenPrefix,
+		Scopes:     service.APIKeyScopes(key),
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+func (r *AuditListReq) filter() service.AuditFilter {
+	limit := r.Limit
+	if limit == 0 {
+		limit = 50
+	}
+	return service.AuditFilter{
+		Event:   r.Event,
+		Outcome: r.Outcome,
+		From:    r.From,
+		To:      r.To,
+		Before:  r.Before,
+		Limit:   limit,
+	}
+}
+
+func NewAuditEventResp(event *db.AuditEvent) AuditEventResp {
+	return AuditEventResp{
+		ID:        event.ID,
+		CreatedAt: event.CreatedAt,
+		Event:     event.Event,
+		Outcome:   event.Outcome,
+		UserID:    event.UserID,
+		ActorID:   event.ActorID,
+		IP:        event.IP,
+		UserAgent: event.UserAgent,
+		Details:   event.Details,
+	}
+}
+
+// NewBookmarkResp is the full representation of a bookmark, with its tags and timestamps.
+func NewBookmarkResp(bookmark *db.Bookmark) BookmarkResp {
+	tags := make([]TagResp, len(bookmark.Tags))
+	for i := range bookmark.Tags {
+		tags[i] = TagResp{
+			ID:   bookmark.Tags[i].ID,
+			Name: bookmark.Tags[i].Name,
+		}
+	}
+	return BookmarkResp{
+		ID:          bookmark.ID,
+		Name:        bookmark.Name,
+		Link:        bookmark.Link,
+		Description: bookmark.Description,
+		Tags:        tags,
+		CreatedAt:   bookmark.CreatedAt,
+		UpdatedAt:   bookmark.UpdatedAt,
+	}
+}
+
+func NewInviteResp(invite *db.Invite) InviteResp {
+	return InviteResp{
+		ID:        invite.ID,
+		Prefix:    invite.CodePrefix,
+		MaxUses:   invite.MaxUses,
+		Uses:      invite.Uses,
+		ExpiresAt: invite.ExpiresAt,
+		CreatedAt: invite.CreatedAt,
+	}
+}
+
+func NewAdminUserResp(user *service.UserSummary) AdminUserResp {
+	return AdminUserResp{
+		ID:               user.ID,
+		Email:            user.Email,
+		Role:             user.Role,
+		EmailVerified:    user.EmailVerifiedAt != nil,
+		TwoFactorEnabled: user.TOTPEnabledAt != nil,
+		DisabledAt:       user.DisabledAt,
+		CreatedAt:        user.CreatedAt,
+		BookmarkCount:    user.BookmarkCount,
+		TagCount:         user.TagCount,
+	}
+}
+
+func (s *HTTPServer) newDataExportResp(export *db.DataExport) DataExportResp {
+	resp := DataExportResp{
+		ID:        export.ID,
+		Status:    export.Status,
+		CreatedAt: export.CreatedAt,
+		ExpiresAt: export.ExpiresAt,
+	}
+	if export.Status == service.DataExportDone {
+		link, expiresAt := s.generalService.DataExportLink(export)
+		resp.DownloadURL = link
+		resp.DownloadURLExpiresAt = &expiresAt
+	}
+	return resp
+}
+
+func NewLoginResp(pair *service.TokenPair) *LoginResp {
+	return &LoginResp{
+		Token:        pair.AccessToken,
+		ExpiresAt:    pair.AccessTokenExpiresAt,
+		RefreshToken: pair.RefreshToken,
+	}
+}
+
+// SendLoginResult answers a login with the tokens or, when a second factor is needed, with the challenge.
+func SendLoginResult(c *fiber.Ctx, result *service.LoginResult) error {
+	if result.Tokens == nil {
+		return c.JSON(&TwoFactorChallengeResp{
+			TwoFactorRequired: true,
+			ChallengeToken:    result.ChallengeToken,
+		})
+	}
+	return c.JSON(NewLoginResp(result.Tokens))
+}
+
+func SendPasswordRejected(c *fiber.Ctx, rejected *passpolicy.Error) error {
+	return c.Status(fiber.StatusBadRequest).JSON(PasswordRejectedResp{
+		Message: "password does not meet the policy",
+		Reasons: rejected.Reasons,
+	})
+}
+
+func SendLoginLocked(c *fiber.Ctx, locked *service.LoginLockedError) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+	return c.Status(fiber.StatusTooManyRequests).SendString(locked.Error())
+}
+
+// audit records the outcome of a request concerning the user's account.
+// When someone else, i.e. an admin, made the request, they are recorded as the actor.
+func (s *HTTPServer) audit(c *fiber.Ctx, event string, userID uint64, err error) {
+	entry := service.AuditEntry{
+		Event:  event,
+		UserID: userID,
+		Client: GetClientInfo(c),
+		Err:    err,
+	}
+	if actor, _ := GetUserFromContext(c); actor != nil && actor.ID != userID {
+		entry.ActorID = actor.ID
+	}
+	s.generalService.Audit(entry)
+}
+
+func GetSessionFromContext(c *fiber.Ctx) (*db.Session, error) {
+	sessionRaw := c.Locals("session")
+	if sessionRaw == nil {
+		return nil, errors.New("no session found in context")
+	}
+	session, ok := sessionRaw.(*db.Session)
+	if !ok {
+		return nil, errors.New("session context value conversion failed")
+	}
+	return session, nil
+}
+
+func GetClientInfo(c *fiber.Ctx) service.ClientInfo {
+	// proxies append the address they saw to a list, earlier entries come from the client and can't be trusted
+	ips := strings.Split(c.IP(), ",")
+	return service.ClientInfo{
+		IP:        strings.TrimSpace(ips[len(ips)-1]),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+	}
+}
+
 func GetParam(c *fiber.Ctx, name string) (string, error) {
 	value := c.Params(name)
 	if value == "" {
@@ -491,13 +2022,18 @@ func GetAndParseParam(c *fiber.Ctx, name string) (uint64, error) {
 	return vv, nil
 }
 
+// censoredFields are the request body fields never written to logs.
+var censoredFields = []string{"password", "current_password", "new_password", "token", "refresh_token",
+	"challenge_token", "code", "recovery_code", "invite_code"}
+
 func censorBody(requestBodyB []byte) []byte {
 	parsedBody := map[string]interface{}{}
 	unmarshalErr := json.Unmarshal(requestBodyB, &parsedBody)
 	if unmarshalErr == nil {
-		_, ok := parsedBody["password"]
-		if ok {
-			parsedBody["password"] = "$censored"
+		for _, field := range censoredFields {
+			if _, ok := parsedBody[field]; ok {
+				parsedBody[field] = "$censored"
+			}
 		}
 		newRequestBodyB, err := json.Marshal(&parsedBody)
 		if err == nil {
@@ -506,3 +2042,50 @@ func censorBody(requestBodyB []byte) []byte {
 	}
 	return requestBodyB
 }
+
+// censoredHeaders are the request headers never written to logs, in lower case.
+var censoredHeaders = []string{"x-token", "authorization", "cookie"}
+
+// censorHeaders censors the values of censoredHeaders in the raw request header,
+// and the query of the request line like censorQuery.
+func censorHeaders(header string) string {
+	lines := strings.Split(header, "\r\n")
+	// GET /path?query HTTP/1.1
+	if parts := strings.Split(lines[0], " "); len(parts) == 3 {
+		if i := strings.IndexByte(parts[1], '?'); i != -1 {
+			parts[1] = parts[1][:i+1] + censorQuery(parts[1][i+1:])
+			lines[0] = strings.Join(parts, " ")
+		}
+	}
+	for i := 1; i < len(lines); i++ {
+		line := lines[i]
+		colon := strings.IndexByte(line, ':')
+		if colon == -1 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:colon]))
+		for _, censored := range censoredHeaders {
+			if name == censored {
+				lines[i] = line[:colon] + ": $censored"
+			}
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// censoredQueryParams are the query parameters never written to logs.
+var censoredQueryParams = []string{"signature", "token", "code", "state"}
+
+func censorQuery(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		// don't log what couldn't be censored
+		return "$censored"
+	}
+	for _, param := range censoredQueryParams {
+		if _, ok := values[param]; ok {
+			values.Set(param, "$censored")
+		}
+	}
+	return values.Encode()
+}
@@ -8,12 +8,26 @@ import (
 func TestCensorBody(t *testing.T) {
 	b := `{
 		"email": "email@email.com",
-		"password": "123456789123"
+		"password": "123456789123",
+		"refresh_token": "secret"
 	}`
 
 	got := censorBody([]byte(b))
 	assert.JSONEq(t, `{
 		"email": "email@email.com",
-		"password": "$censored"
+		"password": "$censored",
+		"refresh_token": "$censored"
 	}`, string(got))
 }
+
+func TestCensorHeaders(t *testing.T) {
+	h := "GET /bookmark?token=secret HTTP/1.1\r\nHost: api.example.com\r\nX-Token: secret\r\nauthorization: Bearer secret\r\n\r\n"
+
+	got := censorHeaders(h)
+	assert.Equal(t, "GET /bookmark?token=%24censored HTTP/1.1\r\nHost: api.example.com\r\nX-Token: $censored\r\nauthorization: $censored\r\n\r\n", got)
+}
+
+func TestCensorQuery(t *testing.T) {
+	got := censorQuery("id=3&expires=1700000000&signature=secret")
+	assert.Equal(t, "expires=1700000000&id=3&signature=%24censored", got)
+}